@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Directory the audio files live in
+var AUDIO_DIR = "audio"
+
+// Results of cross referencing the sound collections against the audio directory
+type auditReport struct {
+	Errors   []string
+	Warnings []string
+}
+
+func (r *auditReport) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *auditReport) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Checks the collections for missing files, sounds that failed to encode, duplicate
+// commands, and files in the audio directory that no sound uses. If loaded is false the
+// buffers haven't been filled yet, so empty buffers aren't reported.
+func auditSounds(colls []*SoundCollection, loaded bool) *auditReport {
+	report := &auditReport{}
+	report.Errors = append(report.Errors, validateCollections(colls)...)
+
+	referenced := make(map[string]bool)
+	for _, coll := range colls {
+		for _, sound := range coll.Sounds {
+			referenced[filepath.Clean(sound.File)] = true
+
+			if _, err := os.Stat(sound.File); err != nil {
+				report.errorf("sound %q in collection %q is missing its file %s", sound.Name, coll.Name, sound.File)
+				continue
+			}
+
+			if frames, _ := store.Peek(sound); loaded && len(frames) == 0 {
+				report.errorf("sound %q in collection %q has no encoded frames", sound.Name, coll.Name)
+			}
+		}
+	}
+
+	files, err := ioutil.ReadDir(AUDIO_DIR)
+	if err != nil {
+		report.errorf("failed to read audio directory %s: %v", AUDIO_DIR, err)
+		return report
+	}
+
+	for _, file := range files {
+		path := filepath.Join(AUDIO_DIR, file.Name())
+		if !file.IsDir() && !referenced[path] {
+			report.warnf("file %s is not used by any sound", path)
+		}
+	}
+
+	return report
+}
+
+// Logs every problem in the report
+func (r *auditReport) Log() {
+	for _, problem := range r.Errors {
+		log.Error(problem)
+	}
+
+	for _, problem := range r.Warnings {
+		log.Warning(problem)
+	}
+}
@@ -3,17 +3,16 @@ package main
 import (
     "regexp"
 	"bytes"
-	"encoding/binary"
 	"flag"
 	"fmt"
-	"io"
 	"math/rand"
 	"os"
-	"os/exec"
 	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
@@ -22,7 +21,6 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
 	"github.com/dustin/go-humanize"
-	"github.com/layeh/gopus"
 	redis "gopkg.in/redis.v3"
 )
 
@@ -33,9 +31,6 @@ var (
 	// Redis client connection (used for stats)
 	rcli *redis.Client
 
-	// Map of Guild id's to *Play channels, used for queuing and rate-limiting guilds
-	queues map[string]chan *Play = make(map[string]chan *Play)
-
 	// Sound encoding settings
 	BITRATE        = 128
 	MAX_QUEUE_SIZE = 6
@@ -43,6 +38,12 @@ var (
 	// Owner
 	OWNER string
 
+	// Path to the sound manifest, used when reloading
+	MANIFEST string
+
+	// All the sound collections we have, loaded from the sound manifest
+	COLLECTIONS []*SoundCollection
+
 	// Shard (or -1)
 	SHARDS []string = make([]string, 0)
 )
@@ -54,18 +55,42 @@ type Play struct {
 	UserID    string
 	Sound     *Sound
 
+	// Collection the sound was picked from
+	Collection *SoundCollection
+
 	// The next play to occur after this, only used for chaining sounds like anotha
 	Next *Play
 
 	// If true, this was a forced play using a specific airhorn sound name
 	Forced bool
+
+	// Silence (in milliseconds) to wait before this play starts, used for gaps in combos
+	Delay int
+
+	// Length (in milliseconds) of the crossfade into this play from the one it's chained to. If
+	// Gapless is set it starts straight after the last sound instead of after a short pause.
+	Crossfade int
+	Gapless   bool
+
+	// How urgently this should be played, shared by everything chained after it
+	Priority playPriority
 }
 
+// SoundCollection represents a group of sounds that share a set of commands
 type SoundCollection struct {
-	Prefix    string
-	Commands  []string
-	Sounds    []*Sound
-	ChainWith *SoundCollection
+	Name     string
+	Prefix   string
+	Commands []string
+	Sounds   []*Sound
+
+	// Rules for what may play after a sound from this collection, like anotha one's airhorn
+	Chains []*ChainRule
+
+	// Encoder settings shared by every sound in the collection
+	Encoder *EncoderProfile
+
+	// Limit on how often a guild can play sounds from this collection, nil for no limit
+	Limit *rateLimit
 
 	soundRange int
 }
@@ -80,323 +105,58 @@ type Sound struct {
 	// Delay (in milliseconds) for the bot to wait before sending the disconnect request
 	PartDelay int
 
-	// Channel used for the encoder routine
-	encodeChan chan []int16
-
-	// Buffer to store encoded PCM packets
-	buffer [][]byte
-}
-
-// Array of all the sounds we have
-var AIRHORN *SoundCollection = &SoundCollection{
-	Prefix: "airhorn",
-	Commands: []string{
-		"!airhorn",
-	},
-	Sounds: []*Sound{
-		createSound("default", 1000, 250),
-		createSound("fourtap", 800, 250),
-	},
-}
-
-var KHALED *SoundCollection = &SoundCollection{
-	Prefix:    "another",
-	ChainWith: AIRHORN,
-	Commands: []string{
-		"!anotha",
-		"!anothaone",
-	},
-	Sounds: []*Sound{
-		createSound("one", 1, 250),
-		createSound("one_classic", 1, 250),
-	},
-}
+	// Path to the source audio file
+	File string
 
-var TSM *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!TSM",
-		"!bestteam",
-	},
-	Sounds: []*Sound{
-		createSound("TSM", 1, 250),
-	},
-}
+	// Loudness (in LUFS) to normalize to, overriding LOUDNESS_TARGET when set
+	TargetLoudness *float64
 
-var BELIEVE *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!believe",
-		"!cantbelieve",
-		"!cb",
-	},
-	Sounds: []*Sound{
-		createSound("cantbelieve", 1, 250),
-	},
-}
-
-var HOW *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!how",
-		"!happentome",
-	},
-	Sounds: []*Sound{
-		createSound("howcouldthis", 1, 250),
-	},
-}
+	// Section of the source to use (in milliseconds), an End of 0 means the end of the file
+	Start int
+	End   int
 
-var FRICK *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!frick",
-	},
-	Sounds: []*Sound{
-		createSound("frick", 1, 250),
-	},
-}
+	// Gain (in dB) applied after normalization
+	Gain float64
 
-var WHEN *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!whenwillyoulearn",
-		"!wwyl",
-	},
-	Sounds: []*Sound{
-		createSound("whenwilllearn", 1, 250),
-	},
-}
+	// Length of the fades (in milliseconds) applied to the start and end of the sound
+	FadeIn  int
+	FadeOut int
 
-var EVENNOW *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!evennow",
-		"!even",
-	},
-	Sounds: []*Sound{
-		createSound("evennow", 1, 250),
-	},
-}
+	// If true, silence is trimmed from both ends, using SilenceThreshold (in dBFS) when set
+	TrimSilence      bool
+	SilenceThreshold *float64
 
-var DOIT *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!doit",
-		"!justdoit",
-	},
-	Sounds: []*Sound{
-		createSound("justdoit", 1, 250),
-	},
-}
+	// Encoder settings for this sound, nil uses the defaults
+	Encoder *EncoderProfile
 
-var OHGOD *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!ohmygod",
-		"!omg",
-	},
-	Sounds: []*Sound{
-		createSound("ohgod", 1, 250),
-	},
-}
+	// Effects applied to this variant of a sound, nil for the original
+	Effects *Effects
 
-var CHERRY *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!rero",
-		"!cherry",
-	},
-	Sounds: []*Sound{
-		createSound("cherry", 1, 250),
-	},
-}
-
-var HELLO *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!hello",
-	},
-	Sounds: []*Sound{
-		createSound("hello", 1, 250),
-	},
-}
-
-var FUCKEDUP *SoundCollection = &SoundCollection{
-	Prefix:    "TSM",
-	Commands: []string{
-		"!fuckedup",
-	},
-	Sounds: []*Sound{
-		createSound("fuckedup", 1, 250),
-	},
-}
-
-var ETHAN *SoundCollection = &SoundCollection{
-	Prefix: "ethan",
-	Commands: []string{
-		"!ethan",
-		"!eb",
-	},
-	Sounds: []*Sound{
-		createSound("classic", 100, 250),
-	},
-}
-
-var DOUBLELIFT *SoundCollection = &SoundCollection{
-	Prefix: "lol",
-	Commands: []string{
-		"!doublelift",
-		"!dl",
-	},
-	Sounds: []*Sound{
-		createSound("doublelift", 100, 250),
-	},
-}
+	// Measured integrated loudness of the source (in LUFS) and the gain (in dB) applied to it
+	Loudness     float64
+	LoudnessGain float64
 
-var PENTA *SoundCollection = &SoundCollection{
-	Prefix: "lol",
-	Commands: []string{
-		"!penta",
-		"!pentakirr",
-	},
-	Sounds: []*Sound{
-		createSound("pentakirr", 1000, 250),
-	},
-}
-
-var WOW *SoundCollection = &SoundCollection{
-	Prefix: "misc",
-	Commands: []string{
-		"!wow",
-	},
-	Sounds: []*Sound{
-		createSound("wow", 100, 250),
-		createSound("waow", 100, 250),
-	},
-}
-
-var OHBABY *SoundCollection = &SoundCollection{
-	Prefix: "misc",
-	Commands: []string{
-		"!triple",
-	},
-	Sounds: []*Sound{
-		createSound("triple", 100, 250),
-	},
-}
-
-var NOICE *SoundCollection = &SoundCollection{
-	Prefix: "misc",
-	Commands: []string{
-		"!noice",
-		"!nice",
-	},
-	Sounds: []*Sound{
-		createSound("noice", 100, 250),
-	},
-}
-
-var NEVER *SoundCollection = &SoundCollection{
-	Prefix: "misc",
-	Commands: []string{
-		"!tobi",
-		"!never",
-	},
-	Sounds: []*Sound{
-		createSound("never", 100, 250),
-	},
-}
-
-var CHOCO *SoundCollection = &SoundCollection{
-	Prefix: "misc",
-	Commands: []string{
-		"!chocolate",
-		"!choco",
-	},
-	Sounds: []*Sound{
-		createSound("chocolate", 100, 250),
-	},
-}
-
-var PROFANITY *SoundCollection = &SoundCollection{
-	Prefix: "misc",
-	Commands: []string{
-		"!profanity",
-	},
-	Sounds: []*Sound{
-		createSound("profanity", 100, 250),
-	},
-}
-
-var CRY *SoundCollection = &SoundCollection{
-	Prefix: "misc",
-	Commands: []string{
-		"!cry",
-	},
-	Sounds: []*Sound{
-		createSound("cry", 100, 250),
-	},
-}
-
-var LOL *SoundCollection = &SoundCollection{
-	Prefix: "misc",
-	Commands: []string{
-		"!lol",
-	},
-	Sounds: []*Sound{
-		createSound("hot", 100, 250),
-	},
-}
+	// Channel used for the encoder routine
+	encodeChan chan []int16
 
-var ONLYGAME *SoundCollection = &SoundCollection{
-	Prefix: "misc",
-	Commands: []string{
-		"!mad",
-		"!game",
-	},
-	Sounds: []*Sound{
-		createSound("onlygame", 100, 250),
-	},
-}
+	// Buffer to store encoded PCM packets
+	buffer [][]byte
 
-var SHEEIT *SoundCollection = &SoundCollection{
-	Prefix: "misc",
-	Commands: []string{
-	},
-	Sounds: []*Sound{
-		createSound("sheeit", 100, 250),
-	},
-}
+	// State of the source file when the buffer was encoded
+	source sourceStamp
 
+	// Held while the sound is being loaded into the store
+	loadMu sync.Mutex
 
+	// Set (under the store's lock) once the sound has been replaced, after which the store
+	// never tracks it again
+	retired bool
 
-var COLLECTIONS []*SoundCollection = []*SoundCollection{
-	FUCKEDUP,
-	AIRHORN,
-	KHALED,
-	ETHAN,
-	DOUBLELIFT,
-	PENTA,
-	WOW,
-	OHBABY,
-	NOICE,
-	NEVER,
-	CHOCO,
-	PROFANITY,
-	CRY,
-	LOL,
-	ONLYGAME,
-	SHEEIT,
-    TSM,
-    OHGOD,
-    HELLO,
-    CHERRY,
-	BELIEVE,
-	DOIT,
-	HOW,
-	FRICK,
-	WHEN,
-	EVENNOW,
+	// Variants of this sound with effects applied, keyed by the effects, and their keys from
+	// least to most recently used
+	variants     map[string]*Sound
+	variantOrder []string
+	variantsMu   sync.Mutex
 }
 
 // Create a Sound struct
@@ -410,52 +170,46 @@ func createSound(Name string, Weight int, PartDelay int) *Sound {
 	}
 }
 
-func (sc *SoundCollection) Load() {
-	for _, sound := range sc.Sounds {
-		sc.soundRange += sound.Weight
-		sound.Load(sc)
-	}
-}
-
 func (s *SoundCollection) Random() *Sound {
-	var (
-		i      int
-		number int = randomRange(0, s.soundRange)
-	)
+	i := pickWeighted(len(s.Sounds), func(i int) float64 {
+		return float64(s.Sounds[i].Weight)
+	}, float64(s.soundRange))
 
-	for _, sound := range s.Sounds {
-		i += sound.Weight
-
-		if number < i {
-			return sound
-		}
+	if i < 0 {
+		return nil
 	}
-	return nil
+	return s.Sounds[i]
 }
 
-// Encode reads data from ffmpeg and encodes it using gopus
-func (s *Sound) Encode() {
-	encoder, err := gopus.NewEncoder(48000, 2, gopus.Audio)
+// Encode reads PCM frames from the encodeChan and encodes them using gopus
+func (s *Sound) Encode() error {
+	// If we bail early, keep draining the channel so Load doesn't block
+	defer func() {
+		for range s.encodeChan {
+		}
+	}()
+
+	profile := s.encoderProfile()
+	encoder, err := profile.newEncoder()
 	if err != nil {
-		fmt.Println("NewEncoder Error:", err)
-		return
+		return fmt.Errorf("failed to create encoder: %v", err)
 	}
 
-	encoder.SetBitrate(BITRATE * 1000)
-	encoder.SetApplication(gopus.Audio)
-
 	for {
 		pcm, ok := <-s.encodeChan
 		if !ok {
 			// if chan closed, exit
-			return
+			return nil
+		}
+
+		if profile.Channels == 1 {
+			pcm = downmixMono(pcm)
 		}
 
 		// try encoding pcm frame with Opus
-		opus, err := encoder.Encode(pcm, 960, 960*2*2)
+		opus, err := encoder.Encode(pcm, FRAME_SIZE, FRAME_SIZE*CHANNELS*2)
 		if err != nil {
-			fmt.Println("Encoding Error:", err)
-			return
+			return fmt.Errorf("failed to encode frame: %v", err)
 		}
 
 		// Append the PCM frame to our buffer
@@ -463,55 +217,179 @@ func (s *Sound) Encode() {
 	}
 }
 
-// Load attempts to load and encode a sound file from disk
-func (s *Sound) Load(c *SoundCollection) error {
-	s.encodeChan = make(chan []int16, 10)
-	defer close(s.encodeChan)
-	go s.Encode()
-
-	path := fmt.Sprintf("audio/%v_%v.wav", c.Prefix, s.Name)
-	ffmpeg := exec.Command("ffmpeg", "-i", path, "-f", "s16le", "-ar", "48000", "-ac", "2", "pipe:1")
-
-	stdout, err := ffmpeg.StdoutPipe()
+// Load attempts to load and encode a sound file from disk, using the cache when we can
+func (s *Sound) Load() error {
+	stamp, err := statSource(s.File)
 	if err != nil {
-		fmt.Println("StdoutPipe Error:", err)
 		return err
 	}
 
-	err = ffmpeg.Start()
-	if err != nil {
-		fmt.Println("RunStart Error:", err)
-		return err
-	}
-
-	for {
-		// read data from ffmpeg stdout
-		InBuf := make([]int16, 960*2)
-		err = binary.Read(stdout, binary.LittleEndian, &InBuf)
+	// Opus files already in the layout Play expects skip processing and encoding entirely. They're
+	// still decoded once so their loudness is measured like every other sound's.
+	if !s.needsPCM() {
+		frames, err := passthroughOpus(s.File)
+		if err == nil {
+			pcm, err := decodeOpusPackets(frames)
+			if err != nil {
+				return fmt.Errorf("failed to load %s: %v", s.File, err)
+			}
 
-		// If this is the end of the file, just return
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.source = stamp
+			s.buffer = frames
+			s.measure(pcm)
 			return nil
 		}
 
+		if err != errUnsupportedFormat {
+			return fmt.Errorf("failed to load %s: %v", s.File, err)
+		}
+	}
+
+	// Effect variants aren't cached, since users can ask for far more of them than we'd want on disk
+	var key string
+	if CACHE_DIR != "" && s.Effects == nil {
+		hash, err := hashSource(s.File)
 		if err != nil {
-			fmt.Println("error reading from ffmpeg stdout :", err)
 			return err
 		}
+		key = s.cacheKey(hash)
+
+		entry, err := readCache(key)
+		if err == nil {
+			s.source = stamp
+			s.buffer = entry.Frames
+			s.Loudness = entry.Loudness
+			s.LoudnessGain = entry.LoudnessGain
+			return nil
+		}
 
-		// write pcm data to the encodeChan
-		s.encodeChan <- InBuf
+		if err != errCacheMiss {
+			log.WithFields(log.Fields{
+				"file":  s.File,
+				"error": err,
+			}).Warning("Ignoring unreadable sound cache")
+		}
+	}
+
+	pcm, err := decodeFile(s.File)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %v", s.File, err)
+	}
+
+	if len(pcm) == 0 {
+		return fmt.Errorf("failed to decode %s: no audio", s.File)
+	}
+
+	pcm = s.process(pcm)
+	if len(pcm) == 0 {
+		return fmt.Errorf("no audio left in %s after trimming", s.File)
 	}
+
+	if err := s.encodePCM(pcm); err != nil {
+		return err
+	}
+	s.source = stamp
+
+	if key != "" {
+		entry := &cacheEntry{Frames: s.buffer, Loudness: s.Loudness, LoudnessGain: s.LoudnessGain}
+		if err := writeCache(key, entry); err != nil {
+			log.WithFields(log.Fields{
+				"file":  s.File,
+				"error": err,
+			}).Warning("Failed to write sound cache")
+		}
+	}
+	return nil
 }
 
-// Plays this sound over the specified VoiceConnection
-func (s *Sound) Play(vc *discordgo.VoiceConnection) {
+// Encodes 48kHz stereo PCM into the sound buffer
+func (s *Sound) encodePCM(pcm []int16) error {
+	s.buffer = make([][]byte, 0)
+	s.encodeChan = make(chan []int16, 10)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Encode()
+	}()
+
+	// Split the PCM into 20ms frames, padding out the last one with silence
+	for i := 0; i < len(pcm); i += FRAME_SIZE * CHANNELS {
+		frame := make([]int16, FRAME_SIZE*CHANNELS)
+		copy(frame, pcm[i:])
+		s.encodeChan <- frame
+	}
+	close(s.encodeChan)
+
+	return <-errc
+}
+
+// Plays this sound over the specified VoiceConnection, starting skip frames in and holding back
+// the last hold frames so the next sound can crossfade out of them. Returns the frames that were
+// held back, and false if it was cut short by the stop channel closing.
+func (s *Sound) Play(vc *discordgo.VoiceConnection, stop <-chan struct{}, volume int, skip int, hold int) ([][]byte, bool) {
+	frames, err := store.Frames(s)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sound": s.Name,
+			"error": err,
+		}).Error("Failed to load sound for playing")
+		return nil, true
+	}
+
+	// Never skip past the end, or hold back more than half of what's left to crossfade
+	if skip > len(frames) {
+		skip = len(frames)
+	}
+	if hold > (len(frames)-skip)/2 {
+		hold = (len(frames) - skip) / 2
+	}
+
 	vc.Speaking(true)
-	defer vc.Speaking(false)
+	if !sendFrames(vc, stop, frames[skip:len(frames)-hold], volume, s.encoderProfile()) {
+		vc.Speaking(false)
+		return nil, false
+	}
 
-	for _, buff := range s.buffer {
-		vc.OpusSend <- buff
+	// Keep speaking if the end is held back, since the crossfade picks up right where we stop
+	if hold == 0 {
+		vc.Speaking(false)
 	}
+	return frames[len(frames)-hold:], true
+}
+
+// Sends encoded frames over a VoiceConnection at the given volume, returning false if it was cut
+// short by the stop channel closing
+func sendFrames(vc *discordgo.VoiceConnection, stop <-chan struct{}, frames [][]byte, volume int, profile *EncoderProfile) bool {
+	// Only pay for re-encoding when the guild changed its volume
+	var (
+		filter *volumeFilter
+		err    error
+	)
+	if volume != 100 {
+		filter, err = newVolumeFilter(volume, profile)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"volume": volume,
+				"error":  err,
+			}).Warning("Failed to create volume filter, playing at full volume")
+		}
+	}
+
+	pacer := newFramePacer(vc.GuildID)
+	defer pacer.Finish()
+
+	for _, buff := range frames {
+		if filter != nil {
+			if scaled, err := filter.Process(buff); err == nil {
+				buff = scaled
+			}
+		}
+
+		if !pacer.Send(vc, stop, buff) {
+			return false
+		}
+	}
+	return true
 }
 
 // Attempts to find the current users voice channel inside a given guild
@@ -540,61 +418,109 @@ func shardContains(guildid string) bool {
 	return true
 }
 
-// Returns a random integer between min and max
-func randomRange(min, max int) int {
-	rand.Seed(time.Now().UTC().UnixNano())
-	return rand.Intn(max-min) + min
+// Returns the collection triggered by a command, or nil if there isn't one
+func findCollection(command string) *SoundCollection {
+	match, _ := regexp.MatchString("she(e+)it", command)
+
+	for _, coll := range getCollections() {
+		if scontains(command, coll.Commands...) || (coll.Sounds[0].Name == "SHEEIT" && match == true) {
+			return coll
+		}
+	}
+	return nil
 }
 
-// Prepares and enqueues a play into the ratelimit/buffer guild queue
-func enqueuePlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollection, sound *Sound) {
-	// Grab the users voice channel
-	channel := getCurrentVoiceChannel(user, guild)
-	if channel == nil {
-		log.WithFields(log.Fields{
-			"user":  user.ID,
-			"guild": guild.ID,
-		}).Warning("Failed to find channel to play sound in")
-		return
+// Returns the sound in a collection with the given name, or nil if there isn't one
+func findSound(coll *SoundCollection, name string) *Sound {
+	for _, sound := range coll.Sounds {
+		if sound.Name == name {
+			return sound
+		}
 	}
+	return nil
+}
 
-	// Create the play
+// Creates the play for a single step, along with its chained play if the collection has one
+func createPlay(guild *discordgo.Guild, channel *discordgo.Channel, user *discordgo.User, step *playStep, fx *Effects) *Play {
 	play := &Play{
-		GuildID:   guild.ID,
-		ChannelID: channel.ID,
-		UserID:    user.ID,
-		Sound:     sound,
-		Forced:    true,
+		GuildID:    guild.ID,
+		ChannelID:  channel.ID,
+		UserID:     user.ID,
+		Sound:      step.Sound,
+		Collection: step.Collection,
+		Forced:     true,
 	}
 
 	// If we didn't get passed a manual sound, generate a random one
 	if play.Sound == nil {
-		play.Sound = coll.Random()
+		play.Sound = step.Collection.Random()
 		play.Forced = false
 	}
+	play.Sound = play.Sound.withEffects(fx)
 
-	// If the collection is a chained one, set the next sound
-	if coll.ChainWith != nil {
+	// If the collection is a chained one, roll for the next sound
+	if rule := step.Collection.nextChain(); rule != nil {
 		play.Next = &Play{
-			GuildID:   play.GuildID,
-			ChannelID: play.ChannelID,
-			UserID:    play.UserID,
-			Sound:     coll.ChainWith.Random(),
-			Forced:    play.Forced,
+			GuildID:    play.GuildID,
+			ChannelID:  play.ChannelID,
+			UserID:     play.UserID,
+			Sound:      rule.sound().withEffects(fx),
+			Collection: rule.Collection,
+			Forced:     play.Forced,
+			Delay:      rule.Delay,
+			Crossfade:  rule.Crossfade,
+			Gapless:    rule.Gapless,
 		}
 	}
 
-	// Check if we already have a connection to this guild
-	//   yes, this isn't threadsafe, but its "OK" 99% of the time
-	_, exists := queues[guild.ID]
+	return play
+}
+
+// Prepares and enqueues a chain of plays (one per step) into the ratelimit/buffer guild queue
+func enqueuePlay(user *discordgo.User, guild *discordgo.Guild, steps []*playStep, fx *Effects) {
+	// Grab the users voice channel
+	channel := getCurrentVoiceChannel(user, guild)
+	if channel == nil {
+		log.WithFields(log.Fields{
+			"user":  user.ID,
+			"guild": guild.ID,
+		}).Warning("Failed to find channel to play sound in")
+		return
+	}
+
+	// Create the plays, linking each step onto the end of the previous one's chain
+	var play, tail *Play
+	for i, step := range steps {
+		next := createPlay(guild, channel, user, step, fx)
+		if play == nil {
+			play = next
+		} else {
+			next.Delay = steps[i-1].Gap
+			tail.Next = next
+		}
 
-	if exists {
-		if len(queues[guild.ID]) < MAX_QUEUE_SIZE {
-			queues[guild.ID] <- play
+		tail = next
+		for tail.Next != nil {
+			tail = tail.Next
 		}
-	} else {
-		queues[guild.ID] = make(chan *Play, MAX_QUEUE_SIZE)
-		playSound(play, nil)
+	}
+
+	priority := priorityFor(guild, user.ID)
+	for next := play; next != nil; next = next.Next {
+		next.Priority = priority
+	}
+
+	// Guilds in mix mode layer plays on top of each other instead of queueing them, and plays
+	// that arrive while a mixer is still running join it even if mix mode was just turned off
+	if enqueueMix(play, getGuildSettings(guild.ID).Mix) {
+		return
+	}
+
+	if !queues.Enqueue(play) {
+		log.WithFields(log.Fields{
+			"user":  user.ID,
+			"guild": guild.ID,
+		}).Info("Queue is full, dropping play")
 	}
 }
 
@@ -632,56 +558,110 @@ func trackSoundStats(play *Play) {
 	}
 }
 
-// Play a sound
-func playSound(play *Play, vc *discordgo.VoiceConnection) (err error) {
+// Plays a single sound on the guild's voice connection, joining the channel first if needed.
+// Returns the play that should follow it, and how many of that play's frames were already sent
+// while crossfading into it.
+func (q *guildQueue) playSound(play *Play, skip int) (next *Play, used int, err error) {
 	log.WithFields(log.Fields{
 		"play": play,
 	}).Info("Playing sound")
 
-	if vc == nil {
-		vc, err = discord.ChannelVoiceJoin(play.GuildID, play.ChannelID, false, false)
+	// A connection kept open while we were idle may have dropped since the last play
+	if q.vc != nil && !q.vc.Ready {
+		q.manager.leave(q.vc)
+		q.vc = nil
+	}
+
+	if q.vc == nil {
+		q.manager.setState(q, queueJoining)
+		q.vc, err = q.manager.join(play.GuildID, play.ChannelID)
 		// vc.Receive = false
 		if err != nil {
 			log.WithFields(log.Fields{
 				"error": err,
 			}).Error("Failed to play sound")
-			delete(queues, play.GuildID)
-			return err
+			q.vc = nil
+			return nil, 0, err
 		}
 	}
+	q.manager.setState(q, queuePlaying)
+	vc := q.vc
+
+	// Crossfaded and gapless plays join straight on to the end of the last sound
+	joined := skip > 0 || play.Gapless
 
 	// If we need to change channels, do that now
 	if vc.ChannelID != play.ChannelID {
 		vc.ChangeChannel(play.ChannelID, false, false)
 		time.Sleep(time.Millisecond * 125)
+		joined = false
 	}
 
 	// Track stats for this play in redis
 	go trackSoundStats(play)
 
 	// Sleep for a specified amount of time before playing the sound
-	time.Sleep(time.Millisecond * 32)
+	if !joined {
+		time.Sleep(time.Millisecond * 32)
+	}
 	_ = "breakpoint"
-	// Play the sound
-	play.Sound.Play(vc)
 
-	// If this is chained, play the chained sound
-	if play.Next != nil {
-		playSound(play.Next, vc)
+	// The sound can be cut short by !stop, which ends everything, or !skip, which moves on to
+	// whatever comes next
+	stop := playbackStop(play.GuildID)
+	interrupt, release := either(stop, q.manager.setCurrent(q, play))
+	defer release()
+
+	// If this is chained, the chained sound is next, otherwise the next one in the queue. Chains
+	// cut short for a higher priority play are dropped.
+	following := func() *Play {
+		if play.Next != nil && !q.manager.wasPreempted(q) {
+			return play.Next
+		}
+		return q.manager.pop(q)
 	}
 
-	// If there is another song in the queue, recurse and play that
-	if len(queues[play.GuildID]) > 0 {
-		play := <-queues[play.GuildID]
-		playSound(play, vc)
-		return nil
+	interrupted := func() (*Play, int, error) {
+		if closed(stop) {
+			return nil, 0, errPlaybackStopped
+		}
+
+		log.WithFields(log.Fields{
+			"play": play,
+		}).Info("Skipped sound")
+		return following(), 0, nil
 	}
 
-	// If the queue is empty, delete it
-	time.Sleep(time.Millisecond * time.Duration(play.Sound.PartDelay))
-	delete(queues, play.GuildID)
-	vc.Disconnect()
-	return nil
+	// Play the sound, holding back the end if whatever comes next might crossfade out of it
+	volume := getGuildSettings(play.GuildID).Volume
+	if !sleepUnlessStopped(play.Delay, interrupt) {
+		return interrupted()
+	}
+
+	held, ok := play.Sound.Play(vc, interrupt, volume, skip, crossfadeFrames(play))
+	if !ok {
+		return interrupted()
+	}
+
+	next = following()
+	if len(held) > 0 {
+		if next != nil && canCrossfade(next, vc) {
+			used, ok = crossfade(vc, interrupt, volume, held, play.Sound, next.Sound)
+			if !ok && closed(stop) {
+				return nil, 0, errPlaybackStopped
+			}
+			return next, used, nil
+		}
+
+		// Nothing to fade into, so just finish the sound
+		ok := sendFrames(vc, interrupt, held, volume, play.Sound.encoderProfile())
+		vc.Speaking(false)
+		if !ok && closed(stop) {
+			return nil, 0, errPlaybackStopped
+		}
+	}
+
+	return next, 0, nil
 }
 
 func onReady(s *discordgo.Session, event *discordgo.Ready) {
@@ -728,6 +708,8 @@ func calculateAirhornsPerSecond(cid string) {
 func displayBotStats(cid string) {
 	stats := runtime.MemStats{}
 	runtime.ReadMemStats(&stats)
+	sounds := store.Stats()
+	playback := totalPlaybackMetrics()
 
 	users := 0
 	for _, guild := range discord.State.Ready.Guilds {
@@ -746,6 +728,10 @@ func displayBotStats(cid string) {
 	fmt.Fprintf(w, "Servers: \t%d\n", len(discord.State.Ready.Guilds))
 	fmt.Fprintf(w, "Users: \t%d\n", users)
 	fmt.Fprintf(w, "Shards: \t%s\n", strings.Join(SHARDS, ", "))
+	fmt.Fprintf(w, "Sounds: \t%d loaded (%s)\n", sounds.Sounds, humanize.Bytes(uint64(sounds.Bytes)))
+	fmt.Fprintf(w, "Sound Cache: \t%d hits, %d misses, %d evictions\n", sounds.Hits, sounds.Misses, sounds.Evictions)
+	fmt.Fprintf(w, "Playback: \t%d frames, %d underruns, %s drift\n", playback.Frames, playback.Underruns, playback.Drift)
+	fmt.Fprintf(w, "Send Latency: \t%s average, %s worst, %s jitter\n", playback.AvgSendLatency(), playback.MaxSendLatency, playback.AvgJitter())
 	fmt.Fprintf(w, "```\n")
 	w.Flush()
 	discord.ChannelMessageSend(cid, buf.String())
@@ -771,6 +757,17 @@ func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate,
 	} else if scontains(parts[len(parts)-1], "aps") && ourShard {
 		s.ChannelMessageSend(m.ChannelID, ":ok_hand: give me a sec m8")
 		go calculateAirhornsPerSecond(m.ChannelID)
+	} else if scontains(parts[len(parts)-1], "reload") {
+		go func() {
+			if err := reloadSounds(MANIFEST); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("Failed to reload sounds")
+				s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Failed to reload sounds: %v", err))
+				return
+			}
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Shard %v reloaded sounds", strings.Join(SHARDS, ",")))
+		}()
 	}
 	return
 }
@@ -780,7 +777,11 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
-	parts := strings.Split(strings.ToLower(m.Content), " ")
+	// Runs of spaces would otherwise leave empty arguments, which get taken for sound names
+	parts := strings.Fields(strings.ToLower(m.Content))
+	if len(parts) == 0 {
+		return
+	}
 
 	channel, _ := discord.State.Channel(m.ChannelID)
 	if channel == nil {
@@ -814,52 +815,182 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}	
 
+	if parts[0] == "!stop" {
+		if !canControlPlayback(guild, m.Author.ID) {
+			s.ChannelMessageSend(channel.ID, fmt.Sprintf("Only server managers and the %v role can stop sounds", CONTROL_ROLE))
+			return
+		}
+
+		stopPlayback(guild.ID)
+		return
+	}
+
+	if parts[0] == "!queue" {
+		handleQueueCommand(s, channel, guild)
+		return
+	}
+
+	if parts[0] == "!skip" || parts[0] == "!clear" {
+		handleQueueControlCommand(s, channel, guild, m.Author, parts[0])
+		return
+	}
+
+	if parts[0] == "!mix" {
+		handleMixCommand(s, channel, guild, m.Author, parts[1:])
+		return
+	}
+
+	if parts[0] == "!volume" {
+		handleVolumeCommand(s, channel, guild, m.Author, parts[1:])
+		return
+	}
+
+	if parts[0] == "!idle" {
+		handleIdleCommand(s, channel, guild, m.Author, parts[1:])
+		return
+	}
+
 	if parts[0] == "!help" || parts[0] == "!commands" || parts[0] == "!h" {
 		help := "`List of commands:`\n\n" +
-		"`!airhorn !airhorn default !airhorn fourtap !anotha one !anotha one_classic !ethan !dl !penta !wow wow !wow waow !triple !noice !tobi !choco !profanity !cry !lol !game !doit !wwyl !evennow !cantbelieve !rero !omg !fuckedup !game !how `"
+		"`!airhorn !airhorn default !airhorn fourtap !anotha one !anotha one_classic !ethan !dl !penta !wow wow !wow waow !triple !noice !tobi !choco !profanity !lol !game !doit !wwyl !evennow !cantbelieve !rero !omg !fuckedup !game !how !stop !skip !clear !queue !volume !mix !idle !combo `\n\n" +
+		"`Add --reverse, --echo, --pitch <0.5-2> or --speed <0.5-2> to any sound`"
 		s.ChannelMessageSend(channel.ID, help)
 		return
 	}
 
+	if parts[0] == "!combo" {
+		handleComboCommand(s, m, channel, guild, parts[1:])
+		return
+	}
+
 	// Find the collection for the command we got
-	for _, coll := range COLLECTIONS {
-	    match,_:=regexp.MatchString("she(e+)it", parts[0])
-                       
-		if scontains(parts[0], coll.Commands...) || (coll.Sounds[0].Name == "SHEEIT" && match == true) {
-
-			// If they passed a specific sound effect, find and select that (otherwise play nothing)
-			var sound *Sound
-			if len(parts) > 1 {
-				for _, s := range coll.Sounds {
-					if parts[1] == s.Name {
-						sound = s
-					}
-				}
-
-				if sound == nil {
-					return
-				}
+	coll := findCollection(parts[0])
+	if coll == nil {
+		return
+	}
+
+	// Pull out any effect modifiers, like --reverse or --pitch 1.5
+	args, fx, err := parseEffects(parts[1:])
+	if err != nil {
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("Couldn't apply effects: %v", err))
+		return
+	}
+
+	// A trailing repeat count like x3 plays the sound that many times in a row
+	repeat := 1
+	if len(args) > 0 {
+		if n, ok := parseRepeat(args[len(args)-1]); ok {
+			if n > MAX_COMBO_LENGTH {
+				s.ChannelMessageSend(channel.ID, fmt.Sprintf("Sounds can be repeated at most %d times", MAX_COMBO_LENGTH))
+				return
 			}
+			repeat = n
+			args = args[:len(args)-1]
+		}
+	}
 
-			go enqueuePlay(m.Author, guild, coll, sound)
+	// If they passed a specific sound effect, find and select that
+	var sound *Sound
+	if len(args) > 0 {
+		sound = findSound(coll, args[0])
+		if sound == nil {
+			s.ChannelMessageSend(channel.ID, fmt.Sprintf("%s has no sound named %s", parts[0], args[0]))
 			return
 		}
 	}
+
+	steps := make([]*playStep, repeat)
+	for i := range steps {
+		steps[i] = &playStep{Collection: coll, Sound: sound}
+	}
+
+	if !checkCooldowns(s, channel, guild, m.Author, steps) {
+		return
+	}
+
+	go enqueuePlay(m.Author, guild, steps, fx)
 }
 
 func main() {
 	var (
-		Token = flag.String("t", "", "Discord Authentication Token")
-		Redis = flag.String("r", "", "Redis Connection String")
-		Shard = flag.String("s", "", "Integers to shard by")
-		Owner = flag.String("o", "", "Owner ID")
-		err   error
+		Token   = flag.String("t", "", "Discord Authentication Token")
+		Redis   = flag.String("r", "", "Redis Connection String")
+		Shard   = flag.String("s", "", "Integers to shard by")
+		Owner   = flag.String("o", "", "Owner ID")
+		Sounds  = flag.String("m", "sounds.json", "Sound manifest path")
+		Cache   = flag.String("c", "cache", "Directory to cache encoded sounds in (empty disables caching)")
+		Audio   = flag.String("a", "audio", "Directory containing the audio files")
+		Check   = flag.Bool("check", false, "Check the sound library for problems and exit")
+		LUFS    = flag.Float64("lufs", LOUDNESS_TARGET, "Loudness to normalize sounds to in LUFS (0 disables normalization)")
+		Memory  = flag.Int64("b", 0, "Memory budget for loaded sounds in MB (0 keeps every sound loaded)")
+		Role    = flag.String("role", CONTROL_ROLE, "Name of the role allowed to control playback")
+		Voices  = flag.Int("voices", MAX_MIX_VOICES, "Maximum number of sounds mixed at once in mix mode")
+		Combo   = flag.Int("combo", MAX_COMBO_LENGTH, "Maximum number of sounds in a combo or repeat")
+		Fade    = flag.Int("crossfade", QUEUE_CROSSFADE, "Milliseconds to crossfade between queued sounds (0 disables)")
+		Metrics = flag.String("metrics", "", "Address to serve playback metrics on, like :9090 (empty disables)")
+		Users   = flag.String("user-limit", USER_LIMIT.String(), "Sounds a user can play in a server, like 5/30s (0 disables)")
+		Guilds  = flag.String("guild-limit", GUILD_LIMIT.String(), "Sounds a server can play, like 15/1m (0 disables)")
+		Slots   = flag.Int("user-slots", MAX_USER_QUEUED, "Sounds a user can have waiting in a server's queue (0 disables)")
+		Preempt = flag.Bool("preempt", PREEMPT_PLAYS, "Cut off the playing sound when an admin or the owner queues one")
+		Idle    = flag.Int("idle", IDLE_TIMEOUT, "Seconds to stay in voice after the queue empties (0 leaves straight away)")
+		err     error
 	)
 	flag.Parse()
 
+	rand.Seed(time.Now().UTC().UnixNano())
+
 	if *Owner != "" {
 		OWNER = *Owner
 	}
+	CONTROL_ROLE = *Role
+
+	// The mixer's channel is sized by this, so anything below one would deadlock it
+	if *Voices < 1 {
+		log.WithFields(log.Fields{
+			"voices": *Voices,
+		}).Fatal("Mix voices must be at least 1")
+	}
+	MAX_MIX_VOICES = *Voices
+
+	if *Combo < 1 {
+		log.WithFields(log.Fields{
+			"combo": *Combo,
+		}).Fatal("Combo length must be at least 1")
+	}
+	MAX_COMBO_LENGTH = *Combo
+
+	MAX_USER_QUEUED = *Slots
+	PREEMPT_PLAYS = *Preempt
+
+	if *Idle < 0 || *Idle > MAX_IDLE_TIMEOUT {
+		log.WithFields(log.Fields{
+			"idle": *Idle,
+			"max":  MAX_IDLE_TIMEOUT,
+		}).Fatal("Idle timeout is out of range")
+	}
+	IDLE_TIMEOUT = *Idle
+
+	if *Fade < 0 || *Fade > MAX_CROSSFADE {
+		log.WithFields(log.Fields{
+			"crossfade": *Fade,
+			"max":       MAX_CROSSFADE,
+		}).Fatal("Crossfade is out of range")
+	}
+	QUEUE_CROSSFADE = *Fade
+
+	USER_LIMIT, err = parseRateLimit(*Users)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Invalid user limit")
+	}
+
+	GUILD_LIMIT, err = parseRateLimit(*Guilds)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Invalid guild limit")
+	}
 
 	// Make sure shard is either empty, or an integer
 	if *Shard != "" {
@@ -876,10 +1007,51 @@ func main() {
 		}
 	}
 
-	// Preload all the sounds
-	log.Info("Preloading sounds...")
-	for _, coll := range COLLECTIONS {
-		coll.Load()
+	// Load the sound definitions
+	LOUDNESS_TARGET = *LUFS
+	AUDIO_DIR = *Audio
+	CACHE_DIR = *Cache
+	MANIFEST = *Sounds
+	COLLECTIONS, err = loadManifest(MANIFEST)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"manifest": *Sounds,
+			"error":    err,
+		}).Fatal("Failed to load sound manifest")
+		return
+	}
+
+	// Preload all the sounds, unless we're short on memory and want to load them as they're played
+	//  (the check needs every sound loaded at once, so it ignores the budget)
+	budget := *Memory * 1024 * 1024
+	if *Check {
+		budget = 0
+	}
+
+	store = newSoundStore(budget)
+	preload := store.budget == 0
+	if preload {
+		log.Info("Preloading sounds...")
+		loadSounds(collectionLoads(COLLECTIONS))
+	}
+
+	// Make sure the sounds we loaded line up with what's on disk
+	report := auditSounds(COLLECTIONS, preload)
+	report.Log()
+
+	if *Check {
+		if len(report.Errors) > 0 {
+			log.WithFields(log.Fields{
+				"errors":   len(report.Errors),
+				"warnings": len(report.Warnings),
+			}).Error("Sound library check failed")
+			os.Exit(1)
+		}
+
+		log.WithFields(log.Fields{
+			"warnings": len(report.Warnings),
+		}).Info("Sound library check passed")
+		return
 	}
 
 	// If we got passed a redis server, try to connect
@@ -948,6 +1120,24 @@ func main() {
 	}
 	*/
 
+	// Reload the sound library whenever we get a SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("Recieved SIGHUP, reloading sounds...")
+			if err := reloadSounds(MANIFEST); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("Failed to reload sounds")
+			}
+		}
+	}()
+
+	if *Metrics != "" {
+		go serveMetrics(*Metrics)
+	}
+
 	// Wait for a signal to quit
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
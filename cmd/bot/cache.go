@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Bump this whenever the cache layout or the encoding pipeline changes
+	CACHE_VERSION = 2
+
+	cacheMagic = "AHOC"
+)
+
+var (
+	// Directory encoded sounds are cached in, empty disables the cache
+	CACHE_DIR string
+
+	errCacheMiss    = errors.New("cache miss")
+	errCacheCorrupt = errors.New("cache file is corrupt")
+)
+
+// Hashes the contents of a sound's source file
+func hashSource(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// A cached sound, holding its encoded frames and what we measured while encoding them
+type cacheEntry struct {
+	Frames       [][]byte
+	Loudness     float64
+	LoudnessGain float64
+}
+
+// Builds a key that changes whenever the source or anything affecting how it's encoded does
+func (s *Sound) cacheKey(sourceHash string) string {
+	return fmt.Sprintf("v%d:%s:%s", CACHE_VERSION, sourceHash, s.encodeSettings())
+}
+
+// Path of the cache file for the given key
+func cachePath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(CACHE_DIR, hex.EncodeToString(sum[:])+".opus")
+}
+
+// Reads the entry for a key from the cache
+func readCache(key string) (*cacheEntry, error) {
+	data, err := ioutil.ReadFile(cachePath(key))
+	if os.IsNotExist(err) {
+		return nil, errCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(data)
+
+	header := make([]byte, len(cacheMagic))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != cacheMagic {
+		return nil, errCacheCorrupt
+	}
+
+	var version, keyLen uint16
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, errCacheCorrupt
+	}
+	if version != CACHE_VERSION {
+		return nil, errCacheMiss
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &keyLen); err != nil || int(keyLen) > r.Len() {
+		return nil, errCacheCorrupt
+	}
+	storedKey := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, storedKey); err != nil || string(storedKey) != key {
+		return nil, errCacheMiss
+	}
+
+	entry := &cacheEntry{}
+	if err := binary.Read(r, binary.LittleEndian, &entry.Loudness); err != nil {
+		return nil, errCacheCorrupt
+	}
+	if err := binary.Read(r, binary.LittleEndian, &entry.LoudnessGain); err != nil {
+		return nil, errCacheCorrupt
+	}
+
+	// Every frame takes at least its 2 byte length, which bounds how many the file can hold
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil || int64(count) > int64(r.Len()/2) {
+		return nil, errCacheCorrupt
+	}
+
+	entry.Frames = make([][]byte, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var size uint16
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil || int(size) > r.Len() {
+			return nil, errCacheCorrupt
+		}
+
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, errCacheCorrupt
+		}
+		entry.Frames = append(entry.Frames, frame)
+	}
+
+	if r.Len() > 0 {
+		return nil, errCacheCorrupt
+	}
+
+	return entry, nil
+}
+
+// Writes the entry for a key to the cache, replacing any existing one
+func writeCache(key string, entry *cacheEntry) error {
+	if err := os.MkdirAll(CACHE_DIR, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(CACHE_DIR, "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	w.WriteString(cacheMagic)
+	binary.Write(w, binary.LittleEndian, uint16(CACHE_VERSION))
+	binary.Write(w, binary.LittleEndian, uint16(len(key)))
+	w.WriteString(key)
+	binary.Write(w, binary.LittleEndian, entry.Loudness)
+	binary.Write(w, binary.LittleEndian, entry.LoudnessGain)
+	binary.Write(w, binary.LittleEndian, uint32(len(entry.Frames)))
+	for _, frame := range entry.Frames {
+		binary.Write(w, binary.LittleEndian, uint16(len(frame)))
+		w.Write(frame)
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// Rename so a crash mid-write never leaves a half written cache file behind
+	return os.Rename(tmp.Name(), cachePath(key))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+// Points the cache at a temporary directory for the length of a test
+func withTestCache(t *testing.T) {
+	old := CACHE_DIR
+	CACHE_DIR = t.TempDir()
+	t.Cleanup(func() {
+		CACHE_DIR = old
+	})
+}
+
+func TestReadCacheRoundTrip(t *testing.T) {
+	withTestCache(t)
+
+	want := &cacheEntry{
+		Frames:       [][]byte{{1, 2, 3}, {4}, {}},
+		Loudness:     -18.5,
+		LoudnessGain: 2.5,
+	}
+	if err := writeCache("key", want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readCache("key")
+	if err != nil {
+		t.Fatalf("reading back the cache: %v", err)
+	}
+	if got.Loudness != want.Loudness || got.LoudnessGain != want.LoudnessGain || len(got.Frames) != len(want.Frames) {
+		t.Errorf("read back %+v, want %+v", got, want)
+	}
+
+	if _, err := readCache("other"); err != errCacheMiss {
+		t.Errorf("reading a missing key gave %v, want a cache miss", err)
+	}
+}
+
+func TestReadCacheRejectsCorruptFiles(t *testing.T) {
+	withTestCache(t)
+
+	if err := writeCache("key", &cacheEntry{Frames: [][]byte{{1, 2, 3}, {4, 5}}, Loudness: -16}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(cachePath("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every truncation of the file, however short, has to be rejected
+	for n := 0; n < len(data); n++ {
+		if err := ioutil.WriteFile(cachePath("key"), data[:n], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if entry, err := readCache("key"); err == nil {
+			t.Errorf("cache truncated to %d of %d bytes was read as %+v", n, len(data), entry)
+		}
+	}
+
+	// A frame count far larger than the file must not be trusted
+	huge := append([]byte(nil), data...)
+	countAt := len(cacheMagic) + 2 + 2 + len("key") + 8 + 8
+	binary.LittleEndian.PutUint32(huge[countAt:], 0xFFFFFFFF)
+	if err := ioutil.WriteFile(cachePath("key"), huge, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCache("key"); err != errCacheCorrupt {
+		t.Errorf("cache with a huge frame count gave %v, want it rejected as corrupt", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// ChainRule describes a sound that may follow a play from a collection
+type ChainRule struct {
+	// Collection to pick the chained sound from
+	Collection *SoundCollection
+
+	// Specific sound to chain, nil picks a random one from Collection
+	Sound *Sound
+
+	// Chance (from 0 to 1) of this rule firing. A collection's rules are mutually exclusive, so
+	// their probabilities add up to at most 1 and the remainder is the chance of no chain.
+	Probability float64
+
+	// Silence (in milliseconds) before the chained sound starts
+	Delay int
+
+	// Length (in milliseconds) of the crossfade into the chained sound, and whether it should
+	// start without the usual short pause
+	Crossfade int
+	Gapless   bool
+}
+
+// Picks an index at random, where each index is chosen with probability weight(i)/total.
+// Returns -1 if the roll lands past every weight, which happens when they add up to less than total.
+func pickWeighted(count int, weight func(int) float64, total float64) int {
+	var (
+		sum  float64
+		roll = rand.Float64() * total
+	)
+
+	for i := 0; i < count; i++ {
+		sum += weight(i)
+
+		if roll < sum {
+			return i
+		}
+	}
+	return -1
+}
+
+// Rolls the collection's chain rules, returning the one that fired or nil if none did
+func (s *SoundCollection) nextChain() *ChainRule {
+	i := pickWeighted(len(s.Chains), func(i int) float64 {
+		return s.Chains[i].Probability
+	}, 1)
+
+	if i < 0 {
+		return nil
+	}
+	return s.Chains[i]
+}
+
+// Returns the sound to play when this rule fires
+func (r *ChainRule) sound() *Sound {
+	if r.Sound != nil {
+		return r.Sound
+	}
+	return r.Collection.Random()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Longest gap (in milliseconds) allowed between the steps of a combo
+const MAX_COMBO_GAP = 5000
+
+// Maximum number of sounds in a combo or repeat
+var MAX_COMBO_LENGTH = 8
+
+// A single sound in a sequence of plays
+type playStep struct {
+	Collection *SoundCollection
+
+	// Specific sound to play, nil picks a random one from the collection
+	Sound *Sound
+
+	// Silence (in milliseconds) before the next step starts
+	Gap int
+}
+
+// Parses a repeat count like "x3"
+func parseRepeat(arg string) (int, bool) {
+	if !strings.HasPrefix(arg, "x") {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(arg[1:])
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// Parses the steps of a combo like "airhorn:fourtap@250 wow:waow x2 noice", where each step is
+// a command with an optional sound name and gap (in milliseconds) after it, and xN repeats the
+// step before it. Returns every problem found rather than stopping at the first.
+func parseCombo(args []string) ([]*playStep, []string) {
+	var (
+		steps    []*playStep
+		problems []string
+	)
+
+	for _, arg := range args {
+		if n, ok := parseRepeat(arg); ok {
+			if len(steps) == 0 {
+				problems = append(problems, fmt.Sprintf("%s has no sound before it to repeat", arg))
+				continue
+			}
+
+			last := steps[len(steps)-1]
+			// Stop just past the limit, so huge counts don't build huge combos before being rejected
+			for i := 1; i < n && len(steps) <= MAX_COMBO_LENGTH; i++ {
+				steps = append(steps, &playStep{Collection: last.Collection, Sound: last.Sound, Gap: last.Gap})
+			}
+			continue
+		}
+
+		step, err := parseComboStep(arg)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", arg, err))
+			continue
+		}
+		steps = append(steps, step)
+	}
+
+	if len(steps) == 0 && len(problems) == 0 {
+		problems = append(problems, "usage is !combo <command>[:sound][@gap] ... (for example !combo airhorn:fourtap@250 wow x2)")
+	}
+
+	if len(steps) > MAX_COMBO_LENGTH {
+		problems = append(problems, fmt.Sprintf("combos can have at most %d sounds", MAX_COMBO_LENGTH))
+	}
+
+	return steps, problems
+}
+
+// Parses a single command[:sound][@gap] step
+func parseComboStep(arg string) (*playStep, error) {
+	step := &playStep{}
+
+	if i := strings.Index(arg, "@"); i >= 0 {
+		gap, err := strconv.Atoi(arg[i+1:])
+		if err != nil || gap < 0 || gap > MAX_COMBO_GAP {
+			return nil, fmt.Errorf("gap must be a number of milliseconds from 0 to %d", MAX_COMBO_GAP)
+		}
+		step.Gap = gap
+		arg = arg[:i]
+	}
+
+	command, name := arg, ""
+	if i := strings.Index(arg, ":"); i >= 0 {
+		command, name = arg[:i], arg[i+1:]
+	}
+
+	step.Collection = findCollection("!" + strings.TrimPrefix(command, "!"))
+	if step.Collection == nil {
+		return nil, fmt.Errorf("there's no !%s command", strings.TrimPrefix(command, "!"))
+	}
+
+	if name != "" {
+		step.Sound = findSound(step.Collection, name)
+		if step.Sound == nil {
+			return nil, fmt.Errorf("!%s has no sound named %s", strings.TrimPrefix(command, "!"), name)
+		}
+	}
+
+	return step, nil
+}
+
+// Plays a sequence of sounds from a !combo command, or reports every invalid step back in chat
+func handleComboCommand(s *discordgo.Session, m *discordgo.MessageCreate, channel *discordgo.Channel, guild *discordgo.Guild, args []string) {
+	args, fx, err := parseEffects(args)
+	if err != nil {
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("Couldn't apply effects: %v", err))
+		return
+	}
+
+	steps, problems := parseCombo(args)
+	if len(problems) > 0 {
+		s.ChannelMessageSend(channel.ID, "Couldn't play that combo:\n"+strings.Join(problems, "\n"))
+		return
+	}
+
+	if !checkCooldowns(s, channel, guild, m.Author, steps) {
+		return
+	}
+
+	go enqueuePlay(m.Author, guild, steps, fx)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	// Limits on how many sounds a user can play in a guild, and how many a guild can play
+	USER_LIMIT  = &rateLimit{Burst: 5, Period: 30 * time.Second}
+	GUILD_LIMIT = &rateLimit{Burst: 15, Period: time.Minute}
+
+	// Users are told they hit a limit at most this often
+	cooldownReplyLimit = &rateLimit{Burst: 1, Period: 10 * time.Second}
+)
+
+// A token bucket limit, allowing Burst plays at once and refilling at Burst per Period
+type rateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// Parses a limit written like "5/30s", where an empty string or "0" means no limit
+func parseRateLimit(value string) (*rateLimit, error) {
+	if value == "" || value == "0" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("limit %q should look like 5/30s", value)
+	}
+
+	burst, err := strconv.Atoi(parts[0])
+	if err != nil || burst < 1 {
+		return nil, fmt.Errorf("limit %q needs a positive number of plays", value)
+	}
+
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("limit %q needs a positive period like 30s", value)
+	}
+
+	return &rateLimit{Burst: burst, Period: period}, nil
+}
+
+func (l *rateLimit) String() string {
+	if l == nil {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Burst, l.Period)
+}
+
+// Tokens per second a limit refills at
+func (l *rateLimit) rate() float64 {
+	return float64(l.Burst) / l.Period.Seconds()
+}
+
+// The tokens left in a bucket as of the last time it was used
+type tokenBucket struct {
+	limit   *rateLimit
+	tokens  float64
+	updated time.Time
+}
+
+// Refills the bucket for the time since it was last used
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*b.limit.rate())
+	b.updated = now
+}
+
+// Returns how long until the bucket has enough tokens for cost, 0 if it already does
+func (b *tokenBucket) wait(cost float64) time.Duration {
+	if b.tokens >= cost {
+		return 0
+	}
+	return time.Duration((cost - b.tokens) / b.limit.rate() * float64(time.Second))
+}
+
+// A single limit that applies to a play
+type cooldownCheck struct {
+	// Identifies the bucket, like "user:<guild>:<user>"
+	Key   string
+	Limit *rateLimit
+
+	// Tokens the play costs, capped to the limit's burst so it can always eventually pass
+	Cost int
+
+	// Explains the limit to the user, like "you're playing sounds too quickly"
+	Reason string
+}
+
+// Token buckets for every user, guild and collection that has played something recently
+type cooldownTracker struct {
+	sync.Mutex
+
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+var cooldowns = &cooldownTracker{buckets: make(map[string]*tokenBucket)}
+
+// Takes tokens for every check if they all have enough to spare. Otherwise nothing is taken, and
+// the check that has the longest to wait is returned along with how long that is.
+func (c *cooldownTracker) Allow(checks []*cooldownCheck) (*cooldownCheck, time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+
+	var (
+		blocked *cooldownCheck
+		longest time.Duration
+	)
+
+	for _, check := range checks {
+		if check.Limit == nil {
+			continue
+		}
+
+		if wait := c.bucket(check, now).wait(check.cost()); wait > longest {
+			blocked, longest = check, wait
+		}
+	}
+
+	if blocked != nil {
+		return blocked, longest
+	}
+
+	for _, check := range checks {
+		if check.Limit != nil {
+			c.buckets[check.Key].tokens -= check.cost()
+		}
+	}
+	return nil, 0
+}
+
+func (check *cooldownCheck) cost() float64 {
+	if check.Cost > check.Limit.Burst {
+		return float64(check.Limit.Burst)
+	}
+	return float64(check.Cost)
+}
+
+// Returns the refilled bucket for a check, creating a full one if it doesn't exist
+func (c *cooldownTracker) bucket(check *cooldownCheck, now time.Time) *tokenBucket {
+	b, ok := c.buckets[check.Key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(check.Limit.Burst), updated: now}
+		c.buckets[check.Key] = b
+	}
+
+	// Limits can change when the sounds are reloaded
+	b.limit = check.Limit
+	b.refill(now)
+	return b
+}
+
+// Every so often, forgets buckets that have been untouched long enough to refill completely,
+// which is the same as not existing
+func (c *cooldownTracker) sweep(now time.Time) {
+	if now.Sub(c.swept) < time.Minute {
+		return
+	}
+	c.swept = now
+
+	for key, b := range c.buckets {
+		if now.Sub(b.updated) >= b.limit.Period {
+			delete(c.buckets, key)
+		}
+	}
+}
+
+// Builds the checks that apply to a user playing a set of steps in a guild
+func playCooldowns(guild *discordgo.Guild, user *discordgo.User, steps []*playStep) []*cooldownCheck {
+	checks := []*cooldownCheck{
+		{
+			Key:    fmt.Sprintf("user:%s:%s", guild.ID, user.ID),
+			Limit:  USER_LIMIT,
+			Cost:   len(steps),
+			Reason: "you're playing sounds too quickly",
+		},
+		{
+			Key:    fmt.Sprintf("guild:%s", guild.ID),
+			Limit:  GUILD_LIMIT,
+			Cost:   len(steps),
+			Reason: "this server is playing sounds too quickly",
+		},
+	}
+
+	byCollection := make(map[*SoundCollection]*cooldownCheck)
+	for _, step := range steps {
+		if step.Collection.Limit == nil {
+			continue
+		}
+
+		if check, ok := byCollection[step.Collection]; ok {
+			check.Cost++
+			continue
+		}
+
+		name := step.Collection.Name
+		if len(step.Collection.Commands) > 0 {
+			name = step.Collection.Commands[0]
+		}
+
+		check := &cooldownCheck{
+			Key:    fmt.Sprintf("collection:%s:%s", guild.ID, step.Collection.Name),
+			Limit:  step.Collection.Limit,
+			Cost:   1,
+			Reason: fmt.Sprintf("%s is cooling down", name),
+		}
+		byCollection[step.Collection] = check
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+// Checks the cooldowns for a play, replying in chat (at most every so often per user) when it's
+// rejected. Returns whether the play can go ahead.
+func checkCooldowns(s *discordgo.Session, channel *discordgo.Channel, guild *discordgo.Guild, user *discordgo.User, steps []*playStep) bool {
+	blocked, wait := cooldowns.Allow(playCooldowns(guild, user, steps))
+	if blocked == nil {
+		return true
+	}
+
+	// Don't let the replies about being rate limited become spam of their own
+	reply := &cooldownCheck{
+		Key:   fmt.Sprintf("reply:%s:%s", guild.ID, user.ID),
+		Limit: cooldownReplyLimit,
+		Cost:  1,
+	}
+	if allowed, _ := cooldowns.Allow([]*cooldownCheck{reply}); allowed == nil {
+		seconds := int(math.Ceil(wait.Seconds()))
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("<@%s> %s, try again in %ds", user.ID, blocked.Reason, seconds))
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/layeh/gopus"
+)
+
+// Length (in milliseconds) of the crossfade between queued plays, 0 plays them one after another
+var QUEUE_CROSSFADE = 0
+
+// Longest crossfade (in milliseconds) allowed, either between queued plays or in a chain rule
+const MAX_CROSSFADE = 2000
+
+// Returns how many frames at the end of a play to hold back, in case what plays next crossfades
+// out of them
+func crossfadeFrames(play *Play) int {
+	if play.Next != nil {
+		if play.Next.Delay > 0 {
+			return 0
+		}
+		return play.Next.Crossfade / 20
+	}
+	return QUEUE_CROSSFADE / 20
+}
+
+// Whether a play can crossfade out of the sound that was just playing on a connection. Plays that
+// need to change channel or start after a delay are always played separately.
+func canCrossfade(next *Play, vc *discordgo.VoiceConnection) bool {
+	return next.ChannelID == vc.ChannelID && next.Delay == 0
+}
+
+// Sends the held back end of one sound mixed with the start of the next, using an equal power
+// fade so the overall level stays steady. Returns how many frames of the next sound were used,
+// which should be skipped when it's played, and false if playback was stopped.
+func crossfade(vc *discordgo.VoiceConnection, stop <-chan struct{}, volume int, held [][]byte, from, to *Sound) (int, bool) {
+	defer vc.Speaking(false)
+
+	frames, err := store.Frames(to)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sound": to.Name,
+			"error": err,
+		}).Error("Failed to load sound for crossfading")
+		frames = nil
+	}
+
+	fromProfile, toProfile := from.encoderProfile(), to.encoderProfile()
+	fromDecoder, err := gopus.NewDecoder(SAMPLE_RATE, fromProfile.Channels)
+	if err != nil {
+		return 0, sendFrames(vc, stop, held, volume, fromProfile)
+	}
+
+	toDecoder, err := gopus.NewDecoder(SAMPLE_RATE, toProfile.Channels)
+	if err != nil {
+		return 0, sendFrames(vc, stop, held, volume, fromProfile)
+	}
+
+	encoder, err := defaultEncoderProfile().newEncoder()
+	if err != nil {
+		return 0, sendFrames(vc, stop, held, volume, fromProfile)
+	}
+
+	pacer := newFramePacer(vc.GuildID)
+	defer pacer.Finish()
+
+	var (
+		used  int
+		scale = float64(volume) / 100
+		total = float64(len(held) * FRAME_SIZE)
+		out   = make([]int16, FRAME_SIZE*CHANNELS)
+	)
+
+	for i, frame := range held {
+		a := decodeFrame(fromDecoder, frame, fromProfile.Channels)
+
+		// If the next sound is shorter than the fade, keep fading out over silence
+		b := make([]int16, FRAME_SIZE*CHANNELS)
+		if i < len(frames) {
+			b = decodeFrame(toDecoder, frames[i], toProfile.Channels)
+			used++
+		}
+
+		for j := range out {
+			t := (float64(i*FRAME_SIZE) + float64(j/CHANNELS)) / total
+			fadeOut := math.Cos(t * math.Pi / 2)
+			fadeIn := math.Sin(t * math.Pi / 2)
+			out[j] = clampInt16((float64(a[j])*fadeOut + float64(b[j])*fadeIn) * scale)
+		}
+
+		encoded, err := encoder.Encode(out, FRAME_SIZE, FRAME_SIZE*CHANNELS*2)
+		if err != nil {
+			continue
+		}
+
+		if !pacer.Send(vc, stop, encoded) {
+			return used, false
+		}
+	}
+
+	return used, true
+}
+
+// Decodes a frame into stereo PCM, returning silence if it can't be decoded
+func decodeFrame(decoder *gopus.Decoder, frame []byte, channels int) []int16 {
+	pcm, err := decoder.Decode(frame, FRAME_SIZE, false)
+	if err != nil {
+		return make([]int16, FRAME_SIZE*CHANNELS)
+	}
+	return upmix(pcm, channels)
+}
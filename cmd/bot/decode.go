@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Sample rate and channel count Discord expects
+	SAMPLE_RATE = 48000
+	CHANNELS    = 2
+
+	// Number of samples per channel in a 20ms frame
+	FRAME_SIZE = 960
+)
+
+// Returned by a decoder when it can't handle a particular file, so the next option can be tried
+var errUnsupportedFormat = errors.New("unsupported audio format")
+
+// A decoder turns an encoded audio stream into 48kHz stereo int16 samples
+type decoder func(r io.Reader) ([]int16, error)
+
+// Native decoders, keyed by file extension
+var decoders = map[string]decoder{
+	".wav":  decodeWAV,
+	".ogg":  decodeVorbis,
+	".oga":  decodeVorbis,
+	".opus": decodeOggOpus,
+	".mp3":  decodeMP3,
+	".flac": decodeFLAC,
+}
+
+// Guesses the type of a file from its first few bytes, returning the extension of the
+// matching decoder or an empty string if nothing matched
+func sniffFormat(header []byte) string {
+	switch {
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return ".wav"
+	case len(header) >= 36 && string(header[0:4]) == "OggS" && string(header[28:36]) == "OpusHead":
+		return ".opus"
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return ".ogg"
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return ".flac"
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return ".mp3"
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		// MPEG audio frame sync
+		return ".mp3"
+	}
+	return ""
+}
+
+// Decodes an audio file into 48kHz stereo int16 samples. The decoder is picked by sniffing
+// the contents of the file, then by its extension, and ffmpeg is used for anything the
+// native decoders can't handle.
+func decodeFile(path string) ([]int16, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, _ := r.Peek(36)
+
+	kind := sniffFormat(header)
+	if kind == "" {
+		kind = strings.ToLower(filepath.Ext(path))
+	}
+
+	if decode, ok := decoders[kind]; ok {
+		pcm, err := decode(r)
+		if err != errUnsupportedFormat {
+			return pcm, err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"file": path,
+	}).Debug("Native decoders can't handle file, falling back to ffmpeg")
+	return decodeFFmpeg(path)
+}
+
+// Decodes an audio file by shelling out to ffmpeg
+func decodeFFmpeg(path string) ([]int16, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, fmt.Errorf("unsupported format and ffmpeg is not installed")
+	}
+
+	var stderr bytes.Buffer
+	ffmpeg := exec.Command("ffmpeg", "-i", path, "-f", "s16le", "-ar", fmt.Sprint(SAMPLE_RATE), "-ac", fmt.Sprint(CHANNELS), "pipe:1")
+	ffmpeg.Stderr = &stderr
+
+	out, err := ffmpeg.Output()
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, lines[len(lines)-1])
+	}
+
+	pcm := make([]int16, len(out)/2)
+	binary.Read(bytes.NewReader(out[:len(pcm)*2]), binary.LittleEndian, pcm)
+	return pcm, nil
+}
+
+// Converts interleaved samples at any rate and channel count into 48kHz stereo
+func toStereo48k(samples []int16, channels, rate int) []int16 {
+	if channels > CHANNELS {
+		samples = downmix(samples, channels)
+		channels = CHANNELS
+	}
+	return upmix(resample(samples, channels, rate), channels)
+}
+
+// Clamps a float sample in the range [-1, 1] to an int16
+func floatToInt16(v float64) int16 {
+	return clampInt16(v * 32767)
+}
+
+// Linearly resamples interleaved samples from the given rate to 48kHz
+func resample(samples []int16, channels, rate int) []int16 {
+	if rate == SAMPLE_RATE || len(samples) == 0 {
+		return samples
+	}
+
+	frames := len(samples) / channels
+	outFrames := int(int64(frames) * SAMPLE_RATE / int64(rate))
+	out := make([]int16, outFrames*channels)
+	step := float64(rate) / SAMPLE_RATE
+
+	for i := 0; i < outFrames; i++ {
+		pos := float64(i) * step
+		idx := int(pos)
+		frac := pos - float64(idx)
+
+		next := idx + 1
+		if next >= frames {
+			next = frames - 1
+		}
+
+		for c := 0; c < channels; c++ {
+			a := float64(samples[idx*channels+c])
+			b := float64(samples[next*channels+c])
+			out[i*channels+c] = int16(a + (b-a)*frac)
+		}
+	}
+
+	return out
+}
+
+// Duplicates mono samples into both stereo channels
+func upmix(samples []int16, channels int) []int16 {
+	if channels == CHANNELS {
+		return samples
+	}
+
+	out := make([]int16, len(samples)*CHANNELS)
+	for i, sample := range samples {
+		out[i*2] = sample
+		out[i*2+1] = sample
+	}
+	return out
+}
+
+// Keeps the front left and right channels of audio with more than two channels
+func downmix(samples []int16, channels int) []int16 {
+	if channels <= CHANNELS {
+		return samples
+	}
+
+	frames := len(samples) / channels
+	out := make([]int16, frames*CHANNELS)
+	for i := 0; i < frames; i++ {
+		out[i*2] = samples[i*channels]
+		out[i*2+1] = samples[i*channels+1]
+	}
+	return out
+}
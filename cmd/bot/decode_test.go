@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Fixtures in testdata, with the sample rate and number of samples per channel in each
+var decodeFixtures = []struct {
+	file     string
+	kind     string
+	rate     int
+	channels int
+	frames   int
+}{
+	{"mono-22050.wav", ".wav", 22050, 1, 5512},
+	{"stereo-44100.wav", ".wav", 44100, 2, 11025},
+	{"mono-44100.ogg", ".ogg", 44100, 1, 44100},
+	{"stereo-44100.ogg", ".ogg", 44100, 2, 72384},
+	{"mono-22050.mp3", ".mp3", 22050, 1, 20 * 576},
+	{"stereo-44100.mp3", ".mp3", 44100, 2, 20 * 1152},
+	{"mono-16000.flac", ".flac", 16000, 1, 4000},
+	{"stereo-44100-24bit.flac", ".flac", 44100, 2, 11025},
+}
+
+func readHeader(t *testing.T, path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	header := make([]byte, 36)
+	n, _ := io.ReadFull(f, header)
+	return header[:n]
+}
+
+func TestSniffFormat(t *testing.T) {
+	for _, fixture := range decodeFixtures {
+		if kind := sniffFormat(readHeader(t, filepath.Join("testdata", fixture.file))); kind != fixture.kind {
+			t.Errorf("sniffFormat(%s) = %q, want %q", fixture.file, kind, fixture.kind)
+		}
+	}
+
+	opus := make([]byte, 36)
+	copy(opus, "OggS")
+	copy(opus[28:], "OpusHead")
+
+	tests := []struct {
+		name   string
+		header []byte
+		kind   string
+	}{
+		{"ogg opus", opus, ".opus"},
+		{"mpeg frame sync", []byte{0xFF, 0xFB, 0x90, 0x00}, ".mp3"},
+		{"id3 tag", []byte("ID3\x04\x00"), ".mp3"},
+		{"riff that isn't wave", []byte("RIFF\x00\x00\x00\x00AVI "), ""},
+		{"text", []byte("hello, world"), ""},
+		{"empty", nil, ""},
+	}
+
+	for _, test := range tests {
+		if kind := sniffFormat(test.header); kind != test.kind {
+			t.Errorf("sniffFormat(%s) = %q, want %q", test.name, kind, test.kind)
+		}
+	}
+}
+
+func TestDecodeFile(t *testing.T) {
+	for _, fixture := range decodeFixtures {
+		pcm, err := decodeFile(filepath.Join("testdata", fixture.file))
+		if err != nil {
+			t.Errorf("decodeFile(%s) failed: %v", fixture.file, err)
+			continue
+		}
+
+		want := int(int64(fixture.frames)*SAMPLE_RATE/int64(fixture.rate)) * CHANNELS
+		if len(pcm) != want {
+			t.Errorf("decodeFile(%s) returned %d samples, want %d", fixture.file, len(pcm), want)
+			continue
+		}
+
+		silent, split := true, false
+		for i := 0; i < len(pcm); i += CHANNELS {
+			if pcm[i] != 0 {
+				silent = false
+			}
+			if pcm[i] != pcm[i+1] {
+				split = true
+			}
+		}
+
+		if silent {
+			t.Errorf("decodeFile(%s) returned silence", fixture.file)
+		}
+
+		// Mono sources are copied into both channels
+		if fixture.channels == 1 && split {
+			t.Errorf("decodeFile(%s) returned different left and right channels for a mono file", fixture.file)
+		}
+	}
+}
+
+// Builds a 16 bit PCM WAV with the given number of channels
+func wavWithChannels(channels, frames int) []byte {
+	buf := &bytes.Buffer{}
+	size := frames * channels * 2
+
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, uint32(36+size))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(buf, binary.LittleEndian, []uint32{16})
+	binary.Write(buf, binary.LittleEndian, []uint16{wavFormatPCM, uint16(channels)})
+	binary.Write(buf, binary.LittleEndian, []uint32{SAMPLE_RATE, uint32(SAMPLE_RATE * channels * 2)})
+	binary.Write(buf, binary.LittleEndian, []uint16{uint16(channels * 2), 16})
+	buf.WriteString("data")
+	binary.Write(buf, binary.LittleEndian, uint32(size))
+	buf.Write(make([]byte, size))
+	return buf.Bytes()
+}
+
+func TestDecodersRejectUnsupported(t *testing.T) {
+	flacData, err := ioutil.ReadFile(filepath.Join("testdata", "mono-16000.flac"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wavData, err := ioutil.ReadFile(filepath.Join("testdata", "mono-22050.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		decode decoder
+		input  []byte
+	}{
+		{"wav decoding flac", decodeWAV, flacData},
+		{"wav with 6 channels", decodeWAV, wavWithChannels(6, 480)},
+		{"vorbis decoding wav", decodeVorbis, wavData},
+		{"mp3 decoding nothing", decodeMP3, nil},
+		{"flac decoding wav", decodeFLAC, wavData},
+	}
+
+	for _, test := range tests {
+		if _, err := test.decode(bytes.NewReader(test.input)); err != errUnsupportedFormat {
+			t.Errorf("%s returned %v, want errUnsupportedFormat", test.name, err)
+		}
+	}
+}
+
+func TestDecodeFileFallsBackToFFmpeg(t *testing.T) {
+	// The native WAV decoder only handles mono and stereo
+	path := filepath.Join(t.TempDir(), "surround.wav")
+	if err := ioutil.WriteFile(path, wavWithChannels(6, 4800), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pcm, err := decodeFile(path)
+	if _, lookErr := exec.LookPath("ffmpeg"); lookErr != nil {
+		if err == nil || !strings.Contains(err.Error(), "ffmpeg is not installed") {
+			t.Errorf("decodeFile without ffmpeg returned %v, want an error saying it isn't installed", err)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Fatalf("decodeFile fell back to ffmpeg and failed: %v", err)
+	}
+	if len(pcm) != 4800*CHANNELS {
+		t.Errorf("ffmpeg returned %d samples, want %d", len(pcm), 4800*CHANNELS)
+	}
+}
+
+func TestDecodeWAVRejectsHugeFmtChunk(t *testing.T) {
+	// A fmt chunk claiming to be 4GB, which mustn't be allocated before it's read
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(0xFFFFFFFF))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(0xFFFFFFFF))
+	buf.Write(make([]byte, 16))
+
+	if _, err := decodeWAV(&buf); err == nil || !strings.Contains(err.Error(), "fmt chunk") {
+		t.Errorf("decodeWAV with a 4GB fmt chunk returned %v, want it rejected", err)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Limits on the pitch and speed factors users can ask for
+	MIN_EFFECT_FACTOR = 0.5
+	MAX_EFFECT_FACTOR = 2.0
+
+	// Factors are rounded to the nearest 1/20th, so nearly identical values share a variant
+	effectFactorSteps = 20
+
+	// Most effect variants kept for each sound, the least recently used is dropped beyond that
+	MAX_EFFECT_VARIANTS = 8
+
+	// Echo repeats this far apart (in milliseconds), each this much quieter than the last
+	echoDelay = 250
+	echoDecay = 0.4
+
+	// Window used for time stretching, about 21ms at 48kHz
+	stretchWindow = 1024
+)
+
+// Effects applied to a sound's PCM before it's encoded, requested with command modifiers
+// like "!airhorn default --reverse --pitch 1.5"
+type Effects struct {
+	Reverse bool
+	Echo    bool
+
+	// Factors applied to the pitch and the playback speed, 1 leaves them unchanged
+	Pitch float64
+	Speed float64
+}
+
+// Splits the effect modifiers out of a command's arguments, returning the remaining arguments
+// and the requested effects (nil if there weren't any)
+func parseEffects(args []string) ([]string, *Effects, error) {
+	var (
+		rest  []string
+		fx    = &Effects{Pitch: 1, Speed: 1}
+		found bool
+	)
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			rest = append(rest, arg)
+			continue
+		}
+
+		found = true
+		switch arg {
+		case "--reverse":
+			fx.Reverse = true
+		case "--echo":
+			fx.Echo = true
+		case "--pitch", "--speed":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("%s needs a value", arg)
+			}
+			i++
+
+			factor, err := strconv.ParseFloat(args[i], 64)
+			// NaN slips through the range check, so rule out anything that isn't finite first
+			if err != nil || math.IsNaN(factor) || math.IsInf(factor, 0) || factor < MIN_EFFECT_FACTOR || factor > MAX_EFFECT_FACTOR {
+				return nil, nil, fmt.Errorf("%s must be a number from %g to %g", arg, MIN_EFFECT_FACTOR, MAX_EFFECT_FACTOR)
+			}
+
+			factor = math.Floor(factor*effectFactorSteps+0.5) / effectFactorSteps
+			if arg == "--pitch" {
+				fx.Pitch = factor
+			} else {
+				fx.Speed = factor
+			}
+		default:
+			return nil, nil, fmt.Errorf("unknown modifier %s", arg)
+		}
+	}
+
+	if !found || fx.String() == "" {
+		return rest, nil, nil
+	}
+	return rest, fx, nil
+}
+
+// Describes the effects, in a stable order so it can be used as a cache key
+func (fx *Effects) String() string {
+	if fx == nil {
+		return ""
+	}
+
+	var parts []string
+	if fx.Reverse {
+		parts = append(parts, "reverse")
+	}
+	if fx.Pitch != 1 {
+		parts = append(parts, fmt.Sprintf("pitch=%g", fx.Pitch))
+	}
+	if fx.Speed != 1 {
+		parts = append(parts, fmt.Sprintf("speed=%g", fx.Speed))
+	}
+	if fx.Echo {
+		parts = append(parts, "echo")
+	}
+	return strings.Join(parts, ",")
+}
+
+// Runs 48kHz stereo PCM through each effect
+func (fx *Effects) apply(pcm []int16) []int16 {
+	if fx.Reverse {
+		reversePCM(pcm)
+	}
+
+	if fx.Pitch != 1 {
+		// Resampling shifts the pitch but also the length, so stretch it back afterwards
+		pcm = timeStretch(resampleBy(pcm, fx.Pitch), 1/fx.Pitch)
+	}
+
+	if fx.Speed != 1 {
+		pcm = timeStretch(pcm, fx.Speed)
+	}
+
+	if fx.Echo {
+		pcm = addEcho(pcm)
+	}
+	return pcm
+}
+
+// Returns the variant of this sound with the given effects applied, creating it the first time
+// it's asked for. Variants are loaded and stored like any other sound but never written to the
+// encoded sound cache, and only the MAX_EFFECT_VARIANTS most recently used are kept.
+func (s *Sound) withEffects(fx *Effects) *Sound {
+	if fx == nil {
+		return s
+	}
+
+	key := fx.String()
+	v, dropped := s.variant(key, fx)
+	if dropped != nil {
+		store.Forget([]*Sound{dropped})
+	}
+	return v
+}
+
+// Looks up or creates the variant for a set of effects, returning it along with the variant it
+// pushed out, if any
+func (s *Sound) variant(key string, fx *Effects) (*Sound, *Sound) {
+	s.variantsMu.Lock()
+	defer s.variantsMu.Unlock()
+
+	if v, ok := s.variants[key]; ok {
+		s.touchVariant(key)
+		return v, nil
+	}
+
+	v := createSound(s.Name, s.Weight, s.PartDelay)
+	v.File = s.File
+	v.TargetLoudness = s.TargetLoudness
+	v.Start = s.Start
+	v.End = s.End
+	v.Gain = s.Gain
+	v.FadeIn = s.FadeIn
+	v.FadeOut = s.FadeOut
+	v.TrimSilence = s.TrimSilence
+	v.SilenceThreshold = s.SilenceThreshold
+	v.Encoder = s.Encoder
+	v.Effects = fx
+
+	if s.variants == nil {
+		s.variants = make(map[string]*Sound)
+	}
+	s.variants[key] = v
+	s.variantOrder = append(s.variantOrder, key)
+
+	if len(s.variantOrder) <= MAX_EFFECT_VARIANTS {
+		return v, nil
+	}
+
+	oldest := s.variantOrder[0]
+	s.variantOrder = s.variantOrder[1:]
+	dropped := s.variants[oldest]
+	delete(s.variants, oldest)
+	return v, dropped
+}
+
+// Moves a variant to the back of the eviction order. Must hold variantsMu.
+func (s *Sound) touchVariant(key string) {
+	for i, k := range s.variantOrder {
+		if k == key {
+			s.variantOrder = append(append(s.variantOrder[:i:i], s.variantOrder[i+1:]...), key)
+			return
+		}
+	}
+}
+
+// Returns every effect variant created for this sound
+func (s *Sound) effectVariants() []*Sound {
+	s.variantsMu.Lock()
+	defer s.variantsMu.Unlock()
+
+	variants := make([]*Sound, 0, len(s.variants))
+	for _, v := range s.variants {
+		variants = append(variants, v)
+	}
+	return variants
+}
+
+// Reverses stereo PCM in place, keeping the channels of each sample together
+func reversePCM(pcm []int16) {
+	frames := len(pcm) / CHANNELS
+	for i, j := 0, frames-1; i < j; i, j = i+1, j-1 {
+		for c := 0; c < CHANNELS; c++ {
+			pcm[i*CHANNELS+c], pcm[j*CHANNELS+c] = pcm[j*CHANNELS+c], pcm[i*CHANNELS+c]
+		}
+	}
+}
+
+// Plays stereo PCM back factor times faster by linear interpolation, changing the pitch and length
+func resampleBy(pcm []int16, factor float64) []int16 {
+	frames := len(pcm) / CHANNELS
+	outFrames := int(float64(frames) / factor)
+	out := make([]int16, outFrames*CHANNELS)
+
+	for i := 0; i < outFrames; i++ {
+		pos := float64(i) * factor
+		idx := int(pos)
+		frac := pos - float64(idx)
+
+		for c := 0; c < CHANNELS; c++ {
+			a := float64(pcm[idx*CHANNELS+c])
+			b := a
+			if idx+1 < frames {
+				b = float64(pcm[(idx+1)*CHANNELS+c])
+			}
+			out[i*CHANNELS+c] = clampInt16(a + (b-a)*frac)
+		}
+	}
+	return out
+}
+
+// Plays stereo PCM back factor times faster without changing its pitch, by overlap-adding
+// Hann windowed grains read at a different rate than they're written
+func timeStretch(pcm []int16, factor float64) []int16 {
+	frames := len(pcm) / CHANNELS
+	if frames < stretchWindow {
+		return resampleBy(pcm, factor)
+	}
+
+	hopOut := stretchWindow / 2
+	hopIn := float64(hopOut) * factor
+	outFrames := int(float64(frames) / factor)
+
+	window := make([]float64, stretchWindow)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(stretchWindow))
+	}
+
+	mixed := make([]float64, (outFrames+stretchWindow)*CHANNELS)
+	weights := make([]float64, outFrames+stretchWindow)
+
+	for grain := 0; ; grain++ {
+		in := int(float64(grain) * hopIn)
+		out := grain * hopOut
+		if in >= frames || out >= outFrames {
+			break
+		}
+
+		for i := 0; i < stretchWindow && in+i < frames; i++ {
+			w := window[i]
+			for c := 0; c < CHANNELS; c++ {
+				mixed[(out+i)*CHANNELS+c] += float64(pcm[(in+i)*CHANNELS+c]) * w
+			}
+			weights[out+i] += w
+		}
+	}
+
+	result := make([]int16, outFrames*CHANNELS)
+	for i := 0; i < outFrames; i++ {
+		w := weights[i]
+		if w < 1e-3 {
+			continue
+		}
+		for c := 0; c < CHANNELS; c++ {
+			result[i*CHANNELS+c] = clampInt16(mixed[i*CHANNELS+c] / w)
+		}
+	}
+	return result
+}
+
+// Adds decaying repeats of stereo PCM, extending it so the echoes can ring out
+func addEcho(pcm []int16) []int16 {
+	delay := msToSample(echoDelay)
+	repeats := 3
+
+	out := make([]float64, len(pcm)+delay*repeats)
+	for i, sample := range pcm {
+		out[i] = float64(sample)
+	}
+
+	for i := delay; i < len(out); i++ {
+		out[i] += out[i-delay] * echoDecay
+	}
+
+	result := make([]int16, len(out))
+	for i, v := range out {
+		result[i] = clampInt16(v)
+	}
+	return result
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEffects(t *testing.T) {
+	tests := []struct {
+		args []string
+		rest []string
+		fx   string
+		err  bool
+	}{
+		{args: []string{"default"}, rest: []string{"default"}},
+		{args: []string{"default", "--reverse", "--echo"}, rest: []string{"default"}, fx: "reverse,echo"},
+		{args: []string{"--pitch", "1.5", "fourtap"}, rest: []string{"fourtap"}, fx: "pitch=1.5"},
+		{args: []string{"--speed", "0.5"}, fx: "speed=0.5"},
+		{args: []string{"--pitch", "1"}},
+		{args: []string{"--pitch", "1.0001"}},
+		{args: []string{"--pitch", "1.52"}, fx: "pitch=1.5"},
+		{args: []string{"--speed", "1.03"}, fx: "speed=1.05"},
+		{args: []string{"--speed"}, err: true},
+		{args: []string{"--speed", "fast"}, err: true},
+		{args: []string{"--speed", "0.25"}, err: true},
+		{args: []string{"--pitch", "3"}, err: true},
+		{args: []string{"--speed", "nan"}, err: true},
+		{args: []string{"--pitch", "NaN"}, err: true},
+		{args: []string{"--speed", "inf"}, err: true},
+		{args: []string{"--pitch", "-Inf"}, err: true},
+		{args: []string{"--loud"}, err: true},
+	}
+
+	for _, test := range tests {
+		rest, fx, err := parseEffects(test.args)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseEffects(%q) = %v, want an error", test.args, fx)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseEffects(%q) failed: %v", test.args, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(rest, test.rest) {
+			t.Errorf("parseEffects(%q) left %q, want %q", test.args, rest, test.rest)
+		}
+
+		if fx.String() != test.fx {
+			t.Errorf("parseEffects(%q) = %q, want %q", test.args, fx.String(), test.fx)
+		}
+	}
+}
+
+func TestWithEffectsBounded(t *testing.T) {
+	s := createSound("default", 1, 0)
+
+	first := s.withEffects(&Effects{Pitch: 0.5, Speed: 1})
+	if again := s.withEffects(&Effects{Pitch: 0.5, Speed: 1}); again != first {
+		t.Error("asking for the same effects twice created two variants")
+	}
+
+	var created []*Sound
+	for i := 1; i <= MAX_EFFECT_VARIANTS*2; i++ {
+		created = append(created, s.withEffects(&Effects{Pitch: 1, Speed: 1 + float64(i)/effectFactorSteps}))
+
+		// Keep the first variant in use so it's never the least recently used
+		s.withEffects(&Effects{Pitch: 0.5, Speed: 1})
+	}
+
+	if count := len(s.effectVariants()); count != MAX_EFFECT_VARIANTS {
+		t.Errorf("sound kept %d variants, want %d", count, MAX_EFFECT_VARIANTS)
+	}
+
+	if first.retired {
+		t.Error("recently used variant was dropped")
+	}
+
+	for i, v := range created {
+		dropped := i < len(created)-(MAX_EFFECT_VARIANTS-1)
+		if v.retired != dropped {
+			t.Errorf("variant %d retired = %v, want %v", i, v.retired, dropped)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+// gopus doesn't expose the in-band FEC or packet loss controls, so we call opus_encoder_ctl
+// on its encoder state ourselves. The symbol is provided by the libopus gopus links in.
+
+// extern int opus_encoder_ctl(void *st, int request, ...);
+//
+// static int airhorn_set_inband_fec(void *st, int value) {
+//   return opus_encoder_ctl(st, 4012, value); // OPUS_SET_INBAND_FEC
+// }
+//
+// static int airhorn_set_packet_loss_perc(void *st, int value) {
+//   return opus_encoder_ctl(st, 4014, value); // OPUS_SET_PACKET_LOSS_PERC
+// }
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+
+	"github.com/layeh/gopus"
+)
+
+// EncoderProfile controls how a sound is encoded to Opus. Zero values fall back to the
+// defaults: BITRATE, stereo, and the audio application mode.
+type EncoderProfile struct {
+	// Bitrate in kbps
+	Bitrate int `json:"bitrate,omitempty"`
+
+	// 1 for mono, 2 for stereo
+	Channels int `json:"channels,omitempty"`
+
+	// Either "audio" or "voip"
+	Application string `json:"application,omitempty"`
+
+	// Enables in-band forward error correction, tuned for the expected packet loss percentage
+	FEC        bool `json:"fec,omitempty"`
+	PacketLoss int  `json:"packet_loss,omitempty"`
+}
+
+var encoderApplications = map[string]gopus.Application{
+	"audio": gopus.Audio,
+	"voip":  gopus.Voip,
+}
+
+// Returns the profile used when nothing else is configured
+func defaultEncoderProfile() *EncoderProfile {
+	return &EncoderProfile{
+		Bitrate:     BITRATE,
+		Channels:    CHANNELS,
+		Application: "audio",
+	}
+}
+
+// Returns a copy of this profile with every field set in other applied on top
+func (p *EncoderProfile) merge(other *EncoderProfile) *EncoderProfile {
+	merged := *p
+	if other == nil {
+		return &merged
+	}
+
+	if other.Bitrate != 0 {
+		merged.Bitrate = other.Bitrate
+	}
+	if other.Channels != 0 {
+		merged.Channels = other.Channels
+	}
+	if other.Application != "" {
+		merged.Application = other.Application
+	}
+	if other.FEC {
+		merged.FEC = true
+	}
+	if other.PacketLoss != 0 {
+		merged.PacketLoss = other.PacketLoss
+	}
+	return &merged
+}
+
+func (p *EncoderProfile) String() string {
+	return fmt.Sprintf("bitrate=%d:channels=%d:app=%s:fec=%t:loss=%d", p.Bitrate, p.Channels, p.Application, p.FEC, p.PacketLoss)
+}
+
+// Returns a description of everything wrong with the profile
+func (p *EncoderProfile) problems() []string {
+	var problems []string
+
+	if p.Bitrate != 0 && (p.Bitrate < 6 || p.Bitrate > 510) {
+		problems = append(problems, fmt.Sprintf("bitrate %d is outside of 6-510 kbps", p.Bitrate))
+	}
+
+	if p.Channels != 0 && p.Channels != 1 && p.Channels != 2 {
+		problems = append(problems, fmt.Sprintf("channels must be 1 or 2, not %d", p.Channels))
+	}
+
+	if _, ok := encoderApplications[p.Application]; p.Application != "" && !ok {
+		problems = append(problems, fmt.Sprintf("unknown application %q", p.Application))
+	}
+
+	if p.PacketLoss < 0 || p.PacketLoss > 100 {
+		problems = append(problems, fmt.Sprintf("packet_loss %d is outside of 0-100", p.PacketLoss))
+	}
+
+	return problems
+}
+
+// Creates an Opus encoder configured for this profile
+func (p *EncoderProfile) newEncoder() (*gopus.Encoder, error) {
+	application := encoderApplications[p.Application]
+
+	encoder, err := gopus.NewEncoder(SAMPLE_RATE, p.Channels, application)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder.SetBitrate(p.Bitrate * 1000)
+	encoder.SetApplication(application)
+
+	if !p.FEC && p.PacketLoss == 0 {
+		return encoder, nil
+	}
+
+	state, err := encoderState(encoder)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.FEC {
+		if ret := C.airhorn_set_inband_fec(state, 1); ret != 0 {
+			return nil, fmt.Errorf("enabling in-band FEC failed with opus error %d", int(ret))
+		}
+	}
+	if p.PacketLoss > 0 {
+		if ret := C.airhorn_set_packet_loss_perc(state, C.int(p.PacketLoss)); ret != 0 {
+			return nil, fmt.Errorf("setting packet loss to %d%% failed with opus error %d", p.PacketLoss, int(ret))
+		}
+	}
+
+	return encoder, nil
+}
+
+// Returns the libopus encoder state behind a gopus encoder, which gopus keeps in the unexported
+// data buffer. Returns an error rather than panicking if a gopus update changes that layout.
+func encoderState(encoder *gopus.Encoder) (unsafe.Pointer, error) {
+	data := reflect.ValueOf(encoder).Elem().FieldByName("data")
+	if !data.IsValid() || data.Kind() != reflect.Slice || data.Type().Elem().Kind() != reflect.Uint8 {
+		return nil, errors.New("gopus encoder has no data buffer, FEC and packet loss can't be set")
+	}
+
+	if data.Len() == 0 {
+		return nil, errors.New("gopus encoder data buffer is empty, FEC and packet loss can't be set")
+	}
+	return unsafe.Pointer(data.Pointer()), nil
+}
+
+// Averages a frame of stereo PCM down to mono
+func downmixMono(pcm []int16) []int16 {
+	out := make([]int16, len(pcm)/CHANNELS)
+	for i := range out {
+		out[i] = int16((int(pcm[i*2]) + int(pcm[i*2+1])) / 2)
+	}
+	return out
+}
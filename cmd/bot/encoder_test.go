@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewEncoderFEC(t *testing.T) {
+	profile := defaultEncoderProfile().merge(&EncoderProfile{FEC: true, PacketLoss: 10})
+
+	encoder, err := profile.newEncoder()
+	if err != nil {
+		t.Fatalf("creating an FEC encoder: %v", err)
+	}
+
+	if _, err := encoder.Encode(make([]int16, FRAME_SIZE*CHANNELS), FRAME_SIZE, FRAME_SIZE*CHANNELS*2); err != nil {
+		t.Errorf("encoding with FEC enabled: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mewkiz/flac"
+)
+
+// Decodes a FLAC stream into 48kHz stereo int16 samples
+func decodeFLAC(r io.Reader) ([]int16, error) {
+	stream, err := flac.New(r)
+	if err != nil {
+		return nil, errUnsupportedFormat
+	}
+
+	var (
+		channels = int(stream.Info.NChannels)
+		shift    = int(stream.Info.BitsPerSample) - 16
+		pcm      = make([]int16, 0, int(stream.Info.NSamples)*channels)
+	)
+
+	for {
+		frame, err := stream.ParseNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode flac frame: %v", err)
+		}
+
+		for i := 0; i < int(frame.BlockSize); i++ {
+			for _, subframe := range frame.Subframes {
+				sample := subframe.Samples[i]
+				if shift > 0 {
+					sample >>= uint(shift)
+				} else {
+					sample <<= uint(-shift)
+				}
+				pcm = append(pcm, int16(sample))
+			}
+		}
+	}
+
+	return toStereo48k(pcm, channels, int(stream.Info.SampleRate)), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// Longest a guild can ask the bot to stay in voice with nothing to play, in seconds
+	MAX_IDLE_TIMEOUT = 600
+
+	// How often a lingering connection checks it still has someone to play to
+	idleCheckInterval = 5 * time.Second
+)
+
+var (
+	// Seconds to stay in voice after the queue empties for guilds that haven't set their own
+	// timeout, 0 leaves as soon as the last sound finishes
+	IDLE_TIMEOUT = 60
+)
+
+// Returns how long a guild stays in voice after its queue empties
+func (gs GuildSettings) idleTimeout() time.Duration {
+	seconds := gs.Idle
+	if seconds < 0 {
+		seconds = IDLE_TIMEOUT
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Whether a voice connection is still up and has someone other than bots in its channel
+func voiceOccupied(vc *discordgo.VoiceConnection) bool {
+	if !vc.Ready {
+		return false
+	}
+
+	guild, err := discord.State.Guild(vc.GuildID)
+	if err != nil {
+		return false
+	}
+
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID != vc.ChannelID || vs.UserID == discord.State.Ready.User.ID {
+			continue
+		}
+
+		member, err := discord.State.Member(guild.ID, vs.UserID)
+		if err != nil || member.User == nil || !member.User.Bot {
+			return true
+		}
+	}
+	return false
+}
+
+// Stays in voice after the queue empties in case another play arrives, returning it. Returns nil
+// once the guild's idle timeout expires, playback is stopped or nobody is left to listen.
+// Guilds in mix mode leave straight away, since their next play will start a mixer instead.
+func (q *guildQueue) linger() *Play {
+	settings := getGuildSettings(q.GuildID)
+	timeout := settings.idleTimeout()
+	if q.vc == nil || timeout <= 0 || settings.Mix {
+		return nil
+	}
+
+	q.manager.setState(q, queueLingering)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	stop := playbackStop(q.GuildID)
+	for {
+		if play := q.manager.pop(q); play != nil {
+			return play
+		}
+
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+			if !q.manager.occupied(q.vc) {
+				log.WithFields(log.Fields{
+					"guild":   q.GuildID,
+					"channel": q.vc.ChannelID,
+				}).Info("Leaving empty voice channel")
+				return nil
+			}
+		case <-timer.C:
+			return nil
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// Shows or changes how long the bot stays in voice after playing everything
+func handleIdleCommand(s *discordgo.Session, channel *discordgo.Channel, guild *discordgo.Guild, user *discordgo.User, args []string) {
+	if len(args) == 0 || args[0] == "" {
+		s.ChannelMessageSend(channel.ID, describeIdle(getGuildSettings(guild.ID)))
+		return
+	}
+
+	if !canControlPlayback(guild, user.ID) {
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("Only server managers and the %v role can change the idle timeout", CONTROL_ROLE))
+		return
+	}
+
+	var idle int
+	switch args[0] {
+	case "default":
+		idle = -1
+	case "off":
+		idle = 0
+	default:
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v < 0 || v > MAX_IDLE_TIMEOUT {
+			s.ChannelMessageSend(channel.ID, fmt.Sprintf("Idle timeout must be a number of seconds from 0 to %d, off or default", MAX_IDLE_TIMEOUT))
+			return
+		}
+		idle = v
+	}
+
+	settings := updateGuildSettings(guild.ID, func(gs *GuildSettings) {
+		gs.Idle = idle
+	})
+
+	log.WithFields(log.Fields{
+		"guild": guild.ID,
+		"user":  user.ID,
+		"idle":  idle,
+	}).Info("Changed guild idle timeout")
+
+	s.ChannelMessageSend(channel.ID, describeIdle(settings))
+}
+
+func describeIdle(gs GuildSettings) string {
+	timeout := gs.idleTimeout()
+	if timeout <= 0 {
+		return "The bot leaves voice as soon as the queue is empty"
+	}
+	return fmt.Sprintf("The bot stays in voice for %v after the queue is empty", timeout)
+}
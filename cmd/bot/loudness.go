@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+)
+
+var (
+	// Integrated loudness (in LUFS) sounds are normalized to, 0 disables normalization
+	LOUDNESS_TARGET = -16.0
+)
+
+const (
+	// Gating block length and step from ITU-R BS.1770 (400ms blocks with 75% overlap)
+	loudnessBlock = SAMPLE_RATE * 400 / 1000
+	loudnessStep  = SAMPLE_RATE * 100 / 1000
+
+	loudnessAbsoluteGate = -70.0
+	loudnessRelativeGate = -10.0
+)
+
+// Second order IIR filter section
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// Returns the two stage K-weighting filter from BS.1770 for 48kHz audio
+func kWeighting() []*biquad {
+	return []*biquad{
+		// High shelf modelling the acoustic effect of the head
+		{b0: 1.53512485958697, b1: -2.69169618940638, b2: 1.19839281085285, a1: -1.69065929318241, a2: 0.73248077421585},
+		// High pass (RLB weighting)
+		{b0: 1.0, b1: -2.0, b2: 1.0, a1: -1.99004745483398, a2: 0.99007225036621},
+	}
+}
+
+// Measures the integrated loudness of 48kHz stereo PCM in LUFS, following EBU R128 / BS.1770.
+// Returns negative infinity for silence.
+func measureLoudness(pcm []int16) float64 {
+	frames := len(pcm) / CHANNELS
+	if frames == 0 {
+		return math.Inf(-1)
+	}
+
+	// K-weight each channel and keep the squared samples
+	squared := make([][]float64, CHANNELS)
+	for c := 0; c < CHANNELS; c++ {
+		filters := kWeighting()
+		squared[c] = make([]float64, frames)
+
+		for i := 0; i < frames; i++ {
+			x := float64(pcm[i*CHANNELS+c]) / 32768
+			for _, f := range filters {
+				x = f.process(x)
+			}
+			squared[c][i] = x * x
+		}
+	}
+
+	// Clips shorter than a single gating block are measured as one block
+	size := loudnessBlock
+	if frames < size {
+		size = frames
+	}
+
+	var powers []float64
+	for start := 0; start+size <= frames; start += loudnessStep {
+		power := 0.0
+		for c := 0; c < CHANNELS; c++ {
+			sum := 0.0
+			for _, v := range squared[c][start : start+size] {
+				sum += v
+			}
+			power += sum / float64(size)
+		}
+
+		if blockLoudness(power) > loudnessAbsoluteGate {
+			powers = append(powers, power)
+		}
+	}
+
+	if len(powers) == 0 {
+		return math.Inf(-1)
+	}
+
+	// Drop blocks more than 10 LU below the loudness of what survived the absolute gate
+	threshold := blockLoudness(mean(powers)) + loudnessRelativeGate
+
+	var gated []float64
+	for _, power := range powers {
+		if blockLoudness(power) > threshold {
+			gated = append(gated, power)
+		}
+	}
+
+	if len(gated) == 0 {
+		return math.Inf(-1)
+	}
+	return blockLoudness(mean(gated))
+}
+
+// Converts the summed mean square of a block into LUFS
+func blockLoudness(power float64) float64 {
+	return -0.691 + 10*math.Log10(power)
+}
+
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// Returns the gain (in dB) that moves audio with the given loudness to the target, limited so
+// the loudest sample doesn't clip
+func normalizationGain(pcm []int16, loudness, target float64) float64 {
+	if math.IsInf(loudness, -1) {
+		return 0
+	}
+
+	gain := target - loudness
+
+	peak := 0
+	for _, sample := range pcm {
+		v := int(sample)
+		if v < 0 {
+			v = -v
+		}
+		if v > peak {
+			peak = v
+		}
+	}
+
+	if peak > 0 {
+		headroom := -20 * math.Log10(float64(peak)/32767)
+		if gain > headroom {
+			gain = headroom
+		}
+	}
+
+	return gain
+}
+
+// Scales PCM in place by a gain in dB, clamping anything that would clip
+func applyGain(pcm []int16, db float64) {
+	if db == 0 {
+		return
+	}
+
+	scale := math.Pow(10, db/20)
+	for i, sample := range pcm {
+		pcm[i] = clampInt16(float64(sample) * scale)
+	}
+}
+
+// Clamps a sample to the int16 range
+func clampInt16(v float64) int16 {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
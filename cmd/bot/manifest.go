@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Manifest is the on-disk description of every sound collection the bot knows about
+type Manifest struct {
+	Collections []*CollectionManifest `json:"collections"`
+}
+
+// CollectionManifest describes a single SoundCollection inside of a manifest
+type CollectionManifest struct {
+	Name      string           `json:"name"`
+	Prefix    string           `json:"prefix"`
+	Commands  []string         `json:"commands"`
+	ChainWith string           `json:"chain_with,omitempty"`
+	Sounds    []*SoundManifest `json:"sounds"`
+
+	// Rules for what may play afterwards, chain_with is shorthand for a rule that always fires
+	Chains []*ChainRuleManifest `json:"chains,omitempty"`
+
+	// Encoder settings for every sound in the collection
+	Encoder *EncoderProfile `json:"encoder,omitempty"`
+
+	// How often a server can play this collection, like "3/1m"
+	Limit string `json:"limit,omitempty"`
+}
+
+// ChainRuleManifest describes a single ChainRule of a collection
+type ChainRuleManifest struct {
+	// Name of the collection to chain with, and optionally a specific sound from it
+	Collection string `json:"collection"`
+	Sound      string `json:"sound,omitempty"`
+
+	// Chance of the rule firing (from 0 to 1), defaults to 1
+	Probability *float64 `json:"probability,omitempty"`
+
+	// Silence (in milliseconds) before the chained sound
+	Delay int `json:"delay,omitempty"`
+
+	// Crossfade (in milliseconds) into the chained sound, or a join with no pause at all
+	Crossfade int  `json:"crossfade,omitempty"`
+	Gapless   bool `json:"gapless,omitempty"`
+}
+
+// SoundManifest describes a single Sound inside of a collection
+type SoundManifest struct {
+	Name      string `json:"name"`
+	Weight    int    `json:"weight"`
+	PartDelay int    `json:"part_delay"`
+
+	// Path to the source audio file, defaults to audio/<prefix>_<name>.wav
+	File string `json:"file,omitempty"`
+
+	// Loudness (in LUFS) to normalize this sound to instead of the global target, 0 disables
+	TargetLoudness *float64 `json:"target_lufs,omitempty"`
+
+	// Section of the file to play (in milliseconds), an end of 0 plays to the end
+	Start int `json:"start,omitempty"`
+	End   int `json:"end,omitempty"`
+
+	// Gain (in dB) applied after normalization
+	Gain float64 `json:"gain,omitempty"`
+
+	// Fade lengths (in milliseconds)
+	FadeIn  int `json:"fade_in,omitempty"`
+	FadeOut int `json:"fade_out,omitempty"`
+
+	// Trims leading and trailing audio quieter than the threshold (in dBFS)
+	TrimSilence      bool     `json:"trim_silence,omitempty"`
+	SilenceThreshold *float64 `json:"silence_threshold,omitempty"`
+
+	// Encoder settings, overriding the ones set on the collection
+	Encoder *EncoderProfile `json:"encoder,omitempty"`
+}
+
+// Reads and validates a sound manifest from disk, returning the collections it describes
+func loadManifest(path string) ([]*SoundCollection, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse sound manifest %s: %v", path, err)
+	}
+
+	colls, problems := manifest.build()
+	problems = append(problems, validateCollections(colls)...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid sound manifest %s:\n  %s", path, strings.Join(problems, "\n  "))
+	}
+
+	return colls, nil
+}
+
+// Converts the manifest into SoundCollections, resolving chain references by name
+func (m *Manifest) build() ([]*SoundCollection, []string) {
+	var (
+		problems []string
+		colls    = make([]*SoundCollection, 0, len(m.Collections))
+		byName   = make(map[string]*SoundCollection)
+	)
+
+	for i, cm := range m.Collections {
+		if cm.Name == "" {
+			problems = append(problems, fmt.Sprintf("collection #%d has no name", i+1))
+			continue
+		}
+
+		if _, exists := byName[cm.Name]; exists {
+			problems = append(problems, fmt.Sprintf("collection %q is defined more than once", cm.Name))
+			continue
+		}
+
+		coll := &SoundCollection{
+			Name:     cm.Name,
+			Prefix:   cm.Prefix,
+			Commands: make([]string, 0, len(cm.Commands)),
+			Sounds:   make([]*Sound, 0, len(cm.Sounds)),
+			Encoder:  cm.Encoder,
+		}
+
+		// Messages are lowercased before they're matched, so commands have to be too
+		for _, command := range cm.Commands {
+			coll.Commands = append(coll.Commands, strings.ToLower(command))
+		}
+
+		limit, err := parseRateLimit(cm.Limit)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("collection %q has an invalid limit: %v", cm.Name, err))
+		}
+		coll.Limit = limit
+
+		for _, sm := range cm.Sounds {
+			sound := createSound(sm.Name, sm.Weight, sm.PartDelay)
+			sound.File = sm.File
+			sound.TargetLoudness = sm.TargetLoudness
+			sound.Start = sm.Start
+			sound.End = sm.End
+			sound.Gain = sm.Gain
+			sound.FadeIn = sm.FadeIn
+			sound.FadeOut = sm.FadeOut
+			sound.TrimSilence = sm.TrimSilence
+			sound.SilenceThreshold = sm.SilenceThreshold
+
+			if cm.Encoder != nil || sm.Encoder != nil {
+				sound.Encoder = (&EncoderProfile{}).merge(cm.Encoder).merge(sm.Encoder)
+			}
+			if sound.File == "" && cm.Prefix != "" {
+				sound.File = filepath.Join(AUDIO_DIR, fmt.Sprintf("%v_%v.wav", cm.Prefix, sm.Name))
+			}
+
+			coll.Sounds = append(coll.Sounds, sound)
+			coll.soundRange += sound.Weight
+		}
+
+		byName[cm.Name] = coll
+		colls = append(colls, coll)
+	}
+
+	// Chains can point forwards, so resolve them once every collection exists
+	for _, cm := range m.Collections {
+		coll := byName[cm.Name]
+		if coll == nil {
+			continue
+		}
+
+		rules := cm.Chains
+		if cm.ChainWith != "" {
+			rules = append([]*ChainRuleManifest{{Collection: cm.ChainWith}}, rules...)
+		}
+
+		for _, rm := range rules {
+			target, ok := byName[rm.Collection]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("collection %q chains with missing collection %q", cm.Name, rm.Collection))
+				continue
+			}
+
+			rule := &ChainRule{
+				Collection:  target,
+				Probability: 1,
+				Delay:       rm.Delay,
+				Crossfade:   rm.Crossfade,
+				Gapless:     rm.Gapless || rm.Crossfade > 0,
+			}
+
+			if rm.Probability != nil {
+				rule.Probability = *rm.Probability
+			}
+
+			if rm.Sound != "" {
+				rule.Sound = findSound(target, rm.Sound)
+				if rule.Sound == nil {
+					problems = append(problems, fmt.Sprintf("collection %q chains with missing sound %q in %q", cm.Name, rm.Sound, rm.Collection))
+					continue
+				}
+			}
+
+			coll.Chains = append(coll.Chains, rule)
+		}
+	}
+
+	return colls, problems
+}
+
+// Checks a set of collections for problems that would only otherwise show up at runtime
+func validateCollections(colls []*SoundCollection) []string {
+	var (
+		problems []string
+		commands = make(map[string]string)
+	)
+
+	for _, coll := range colls {
+		if len(coll.Sounds) == 0 {
+			problems = append(problems, fmt.Sprintf("collection %q has no sounds", coll.Name))
+		}
+
+		for _, command := range coll.Commands {
+			if owner, exists := commands[command]; exists {
+				problems = append(problems, fmt.Sprintf("command %q is used by both %q and %q", command, owner, coll.Name))
+				continue
+			}
+			commands[command] = coll.Name
+		}
+
+		total := 0.0
+		for _, rule := range coll.Chains {
+			if rule.Probability < 0 || rule.Probability > 1 {
+				problems = append(problems, fmt.Sprintf("collection %q has a chain with a probability outside 0 to 1", coll.Name))
+			}
+			if rule.Delay < 0 {
+				problems = append(problems, fmt.Sprintf("collection %q has a chain with a negative delay", coll.Name))
+			}
+			if rule.Crossfade < 0 || rule.Crossfade > MAX_CROSSFADE {
+				problems = append(problems, fmt.Sprintf("collection %q has a chain with a crossfade outside 0 to %d", coll.Name, MAX_CROSSFADE))
+			}
+			if rule.Crossfade > 0 && rule.Delay > 0 {
+				problems = append(problems, fmt.Sprintf("collection %q has a chain with both a delay and a crossfade", coll.Name))
+			}
+			total += rule.Probability
+		}
+
+		// Leave a little slack for probabilities like 0.1 that don't add up exactly
+		if total > 1+1e-9 {
+			problems = append(problems, fmt.Sprintf("collection %q has chain probabilities adding up to more than 1", coll.Name))
+		}
+
+		names := make(map[string]bool)
+		for _, sound := range coll.Sounds {
+			switch {
+			case sound.Name == "":
+				problems = append(problems, fmt.Sprintf("collection %q has a sound with no name", coll.Name))
+			case names[sound.Name]:
+				problems = append(problems, fmt.Sprintf("collection %q has more than one sound named %q", coll.Name, sound.Name))
+			}
+			names[sound.Name] = true
+
+			if sound.Weight <= 0 {
+				problems = append(problems, fmt.Sprintf("sound %q in collection %q must have a positive weight", sound.Name, coll.Name))
+			}
+
+			if sound.PartDelay < 0 {
+				problems = append(problems, fmt.Sprintf("sound %q in collection %q has a negative part_delay", sound.Name, coll.Name))
+			}
+
+			if sound.Start < 0 || sound.End < 0 || (sound.End > 0 && sound.End <= sound.Start) {
+				problems = append(problems, fmt.Sprintf("sound %q in collection %q has an invalid start/end range", sound.Name, coll.Name))
+			}
+
+			if sound.FadeIn < 0 || sound.FadeOut < 0 {
+				problems = append(problems, fmt.Sprintf("sound %q in collection %q has a negative fade", sound.Name, coll.Name))
+			}
+
+			if sound.Encoder != nil {
+				for _, problem := range sound.Encoder.problems() {
+					problems = append(problems, fmt.Sprintf("sound %q in collection %q has a bad encoder: %s", sound.Name, coll.Name, problem))
+				}
+			}
+
+			if sound.File == "" {
+				problems = append(problems, fmt.Sprintf("sound %q in collection %q has no file and the collection has no prefix", sound.Name, coll.Name))
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShippedManifest(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("../.."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	colls, err := loadManifest("sounds.json")
+	if err != nil {
+		t.Fatalf("loading the shipped manifest: %v", err)
+	}
+
+	for _, problem := range auditSounds(colls, false).Errors {
+		t.Error(problem)
+	}
+}
+
+func TestManifestCommandCase(t *testing.T) {
+	sound := []*SoundManifest{{Name: "s", Weight: 1, File: "s.wav"}}
+
+	colls, problems := (&Manifest{Collections: []*CollectionManifest{
+		{Name: "tsm", Commands: []string{"!TSM", "!bestteam"}, Sounds: sound},
+	}}).build()
+	if len(problems) > 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	if command := colls[0].Commands[0]; command != "!tsm" {
+		t.Errorf("command !TSM was built as %q, want !tsm", command)
+	}
+
+	colls, _ = (&Manifest{Collections: []*CollectionManifest{
+		{Name: "a", Commands: []string{"!Cry"}, Sounds: sound},
+		{Name: "b", Commands: []string{"!cry"}, Sounds: sound},
+	}}).build()
+	problems = validateCollections(colls)
+	if len(problems) != 1 || !strings.Contains(problems[0], `"!cry"`) {
+		t.Errorf("commands differing only by case gave problems %v, want one duplicate", problems)
+	}
+}
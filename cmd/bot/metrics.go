@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Serves playback metrics in the Prometheus text format on the given address
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	log.WithFields(log.Fields{
+		"addr": addr,
+	}).Info("Serving metrics")
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.WithFields(log.Fields{
+			"addr":  addr,
+			"error": err,
+		}).Error("Metrics server failed")
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	all := allPlaybackMetrics()
+
+	guilds := make([]string, 0, len(all))
+	for id := range all {
+		guilds = append(guilds, id)
+	}
+	sort.Strings(guilds)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric := func(name, kind, help string, value func(m playbackMetrics) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		for _, id := range guilds {
+			fmt.Fprintf(w, "%s{guild=%q} %g\n", name, id, value(all[id]))
+		}
+	}
+
+	metric("airhorn_playback_frames_total", "counter", "Frames sent to voice connections.",
+		func(m playbackMetrics) float64 { return float64(m.Frames) })
+	metric("airhorn_playback_underruns_total", "counter", "Frames that were ready more than a frame late.",
+		func(m playbackMetrics) float64 { return float64(m.Underruns) })
+	metric("airhorn_playback_send_latency_seconds_total", "counter", "Time spent waiting for the voice sender to accept frames.",
+		func(m playbackMetrics) float64 { return m.SendLatency.Seconds() })
+	metric("airhorn_playback_send_latency_max_seconds", "gauge", "Longest wait for the voice sender to accept a frame.",
+		func(m playbackMetrics) float64 { return m.MaxSendLatency.Seconds() })
+	metric("airhorn_playback_jitter_seconds_total", "counter", "Total deviation of the gaps between frames from 20ms.",
+		func(m playbackMetrics) float64 { return m.Jitter.Seconds() })
+	metric("airhorn_playback_drift_seconds", "gauge", "How far behind schedule the most recent sound finished, negative when ahead.",
+		func(m playbackMetrics) float64 { return m.LastDrift.Seconds() })
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/layeh/gopus"
+)
+
+var (
+	// Maximum number of plays mixed together in a guild, extra plays are dropped
+	MAX_MIX_VOICES = 4
+
+	// Map of Guild id's to the mixer playing in that guild
+	mixers   map[string]*mixer = make(map[string]*mixer)
+	mixersMu sync.Mutex
+)
+
+// Samples above this level are compressed instead of clipping when voices are summed
+const mixKnee = 24576.0
+
+// Layers every play in a guild into a single stream, used when the guild has mix mode on
+type mixer struct {
+	GuildID   string
+	ChannelID string
+
+	// Plays waiting to be picked up by the mixing loop
+	add chan *Play
+
+	// Plays that are mixing or waiting to, guarded by mixersMu
+	voices int
+
+	// Stop channel registered for this mixer's playback, and its voice connection once joined
+	stop <-chan struct{}
+	vc   *discordgo.VoiceConnection
+}
+
+// A single play being mixed, decoded one frame at a time
+type mixVoice struct {
+	play     *Play
+	frames   [][]byte
+	pos      int
+	silence  int
+	channels int
+	decoder  *gopus.Decoder
+}
+
+func newMixVoice(play *Play) (*mixVoice, error) {
+	frames, err := store.Frames(play.Sound)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := play.Sound.encoderProfile().Channels
+	decoder, err := gopus.NewDecoder(SAMPLE_RATE, channels)
+	if err != nil {
+		return nil, err
+	}
+
+	go trackSoundStats(play)
+
+	return &mixVoice{
+		play:     play,
+		frames:   frames,
+		silence:  play.Delay / 20,
+		channels: channels,
+		decoder:  decoder,
+	}, nil
+}
+
+// Decodes the next frame as stereo PCM, returning false once the voice is finished
+func (v *mixVoice) next() ([]int16, bool) {
+	// Plays with a delay start with that many frames of silence
+	if v.silence > 0 {
+		v.silence--
+		return make([]int16, FRAME_SIZE*CHANNELS), true
+	}
+
+	if v.pos >= len(v.frames) {
+		return nil, false
+	}
+
+	// Treat a frame we can't decode as silence rather than cutting the sound off
+	pcm := decodeFrame(v.decoder, v.frames[v.pos], v.channels)
+	v.pos++
+	return pcm, true
+}
+
+// Hands a play to the guild's mixer, starting one if start is set. Returns false if there's no
+// mixer to use or the guild is already playing through its queue, in which case the play
+// should be queued as normal.
+func enqueueMix(play *Play, start bool) bool {
+	mixersMu.Lock()
+	defer mixersMu.Unlock()
+
+	if m, ok := mixers[play.GuildID]; ok {
+		if m.voices < MAX_MIX_VOICES {
+			m.voices++
+			m.add <- play
+		}
+		return true
+	}
+
+	if !start {
+		return false
+	}
+
+	if queues.Active(play.GuildID) {
+		return false
+	}
+
+	m := &mixer{
+		GuildID:   play.GuildID,
+		ChannelID: play.ChannelID,
+		add:       make(chan *Play, MAX_MIX_VOICES),
+		voices:    1,
+	}
+	m.add <- play
+	mixers[play.GuildID] = m
+
+	m.stop = startPlayback(play.GuildID)
+	go m.run()
+	return true
+}
+
+// Joins the voice channel and mixes plays until there are none left or playback is stopped
+func (m *mixer) run() {
+	vc, err := discord.ChannelVoiceJoin(m.GuildID, m.ChannelID, false, false)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": m.GuildID,
+			"error": err,
+		}).Error("Failed to join voice channel for mixing")
+		m.finish(true)
+		return
+	}
+	m.vc = vc
+
+	encoder, err := defaultEncoderProfile().newEncoder()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": m.GuildID,
+			"error": err,
+		}).Error("Failed to create mixer encoder")
+		m.finish(true)
+		return
+	}
+
+	vc.Speaking(true)
+
+	pacer := newFramePacer(m.GuildID)
+	defer pacer.Finish()
+
+	mix := make([]float64, FRAME_SIZE*CHANNELS)
+	out := make([]int16, FRAME_SIZE*CHANNELS)
+
+	var active []*mixVoice
+	for {
+		// Pick up anything that was enqueued since the last frame
+		for len(m.add) > 0 {
+			active = m.start(active, <-m.add)
+		}
+
+		if len(active) == 0 {
+			if m.finish(false) {
+				return
+			}
+			continue
+		}
+
+		for i := range mix {
+			mix[i] = 0
+		}
+
+		remaining := active[:0]
+		for _, v := range active {
+			pcm, ok := v.next()
+			if !ok {
+				// Chained plays carry on as a new voice in the same slot
+				if v.play.Next != nil {
+					remaining = m.start(remaining, v.play.Next)
+				} else {
+					m.done()
+				}
+				continue
+			}
+
+			for i, sample := range pcm {
+				mix[i] += float64(sample)
+			}
+			remaining = append(remaining, v)
+		}
+		active = remaining
+
+		scale := float64(getGuildSettings(m.GuildID).Volume) / 100
+		for i, v := range mix {
+			out[i] = softClip(v * scale)
+		}
+
+		frame, err := encoder.Encode(out, FRAME_SIZE, FRAME_SIZE*CHANNELS*2)
+		if err != nil {
+			continue
+		}
+
+		if !pacer.Send(vc, m.stop, frame) {
+			m.finish(true)
+			return
+		}
+	}
+}
+
+// Adds a voice for a play, dropping the play if its sound can't be loaded
+func (m *mixer) start(active []*mixVoice, play *Play) []*mixVoice {
+	log.WithFields(log.Fields{
+		"play": play,
+	}).Info("Mixing sound")
+
+	v, err := newMixVoice(play)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sound": play.Sound.Name,
+			"error": err,
+		}).Error("Failed to load sound for mixing")
+		m.done()
+		return active
+	}
+	return append(active, v)
+}
+
+// Releases the slot held by a finished voice
+func (m *mixer) done() {
+	mixersMu.Lock()
+	m.voices--
+	mixersMu.Unlock()
+}
+
+// Removes the mixer if it has nothing left to play (or force is set), returning whether it was
+// removed. It leaves voice and ends its playback first, under the same lock, so a new mixer for
+// the guild can't start on the connection it's leaving or lose its stop channel to this one.
+func (m *mixer) finish(force bool) bool {
+	mixersMu.Lock()
+	defer mixersMu.Unlock()
+
+	if !force && m.voices > 0 {
+		return false
+	}
+
+	if m.vc != nil {
+		m.vc.Speaking(false)
+		m.vc.Disconnect()
+	}
+	endPlayback(m.GuildID, m.stop)
+	delete(mixers, m.GuildID)
+	return true
+}
+
+// Passes quiet samples through untouched and smoothly compresses loud ones, so summing a few
+// airhorns saturates instead of hard clipping
+func softClip(v float64) int16 {
+	magnitude := math.Abs(v)
+	if magnitude <= mixKnee {
+		return int16(v)
+	}
+
+	headroom := 32767 - mixKnee
+	magnitude = mixKnee + headroom*math.Tanh((magnitude-mixKnee)/headroom)
+	return clampInt16(math.Copysign(magnitude, v))
+}
+
+// Shows whether the guild has mix mode on, or switches it if the user is allowed to control playback
+func handleMixCommand(s *discordgo.Session, channel *discordgo.Channel, guild *discordgo.Guild, user *discordgo.User, args []string) {
+	if len(args) == 0 || args[0] == "" {
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("Mix mode is %s", onOff(getGuildSettings(guild.ID).Mix)))
+		return
+	}
+
+	if !canControlPlayback(guild, user.ID) {
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("Only server managers and the %v role can change mix mode", CONTROL_ROLE))
+		return
+	}
+
+	var mix bool
+	switch args[0] {
+	case "on":
+		mix = true
+	case "off":
+		mix = false
+	default:
+		s.ChannelMessageSend(channel.ID, "Mix mode must be on or off")
+		return
+	}
+
+	updateGuildSettings(guild.ID, func(gs *GuildSettings) {
+		gs.Mix = mix
+	})
+
+	log.WithFields(log.Fields{
+		"guild": guild.ID,
+		"user":  user.ID,
+		"mix":   mix,
+	}).Info("Changed guild mix mode")
+
+	s.ChannelMessageSend(channel.ID, fmt.Sprintf("Mix mode is %s", onOff(mix)))
+}
+
+func onOff(v bool) string {
+	if v {
+		return "on"
+	}
+	return "off"
+}
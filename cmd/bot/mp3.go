@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// Decodes an MP3 stream into 48kHz stereo int16 samples
+func decodeMP3(r io.Reader) ([]int16, error) {
+	d, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, errUnsupportedFormat
+	}
+
+	// The decoder always produces 16 bit little endian stereo
+	data, err := ioutil.ReadAll(d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode mp3: %v", err)
+	}
+
+	pcm := make([]int16, len(data)/2)
+	binary.Read(bytes.NewReader(data[:len(pcm)*2]), binary.LittleEndian, pcm)
+	return toStereo48k(pcm, CHANNELS, d.SampleRate()), nil
+}
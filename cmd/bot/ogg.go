@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// Decodes an Ogg Vorbis stream into 48kHz stereo int16 samples
+func decodeVorbis(r io.Reader) ([]int16, error) {
+	// The vorbis library never gives up looking for a page in something that isn't Ogg at all
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(4); err != nil || string(magic) != "OggS" {
+		return nil, errUnsupportedFormat
+	}
+
+	samples, format, err := oggvorbis.ReadAll(br)
+	if err != nil {
+		// Ogg can hold codecs other than vorbis, let something else have a go at it
+		return nil, errUnsupportedFormat
+	}
+
+	pcm := make([]int16, len(samples))
+	for i, sample := range samples {
+		pcm[i] = floatToInt16(float64(sample))
+	}
+
+	return toStereo48k(pcm, format.Channels, format.SampleRate), nil
+}
+
+// Reads every packet of the first logical stream in an Ogg container
+func readOggPackets(r io.Reader) ([][]byte, error) {
+	var (
+		packets [][]byte
+		partial []byte
+		serial  uint32
+		started bool
+	)
+
+	for {
+		var header [27]byte
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read ogg page header: %v", err)
+		}
+
+		if string(header[0:4]) != "OggS" {
+			return nil, fmt.Errorf("invalid ogg page capture pattern")
+		}
+
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(r, segments); err != nil {
+			return nil, fmt.Errorf("failed to read ogg segment table: %v", err)
+		}
+
+		size := 0
+		for _, lacing := range segments {
+			size += int(lacing)
+		}
+
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("failed to read ogg page: %v", err)
+		}
+
+		// Skip pages belonging to any other multiplexed stream
+		pageSerial := binary.LittleEndian.Uint32(header[14:18])
+		if !started {
+			serial = pageSerial
+			started = true
+		} else if pageSerial != serial {
+			continue
+		}
+
+		// A lacing value below 255 ends a packet, otherwise it continues into the next segment
+		offset := 0
+		for _, lacing := range segments {
+			partial = append(partial, body[offset:offset+int(lacing)]...)
+			offset += int(lacing)
+
+			if lacing < 255 {
+				packets = append(packets, partial)
+				partial = nil
+			}
+		}
+	}
+
+	return packets, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/layeh/gopus"
+)
+
+// Largest number of samples per channel a single Opus packet can hold (120ms)
+const maxOpusPacketSize = 5760
+
+// Contents of an OpusHead identification header
+type opusHead struct {
+	Channels      uint8
+	PreSkip       uint16
+	SampleRate    uint32
+	MappingFamily uint8
+}
+
+// Splits an Ogg Opus stream into its identification header and audio packets
+func readOggOpus(r io.Reader) (*opusHead, [][]byte, error) {
+	packets, err := readOggPackets(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(packets) < 2 || len(packets[0]) < 19 || string(packets[0][0:8]) != "OpusHead" {
+		return nil, nil, errUnsupportedFormat
+	}
+
+	head := &opusHead{
+		Channels:      packets[0][9],
+		PreSkip:       binary.LittleEndian.Uint16(packets[0][10:12]),
+		SampleRate:    binary.LittleEndian.Uint32(packets[0][12:16]),
+		MappingFamily: packets[0][18],
+	}
+
+	// The second packet is always OpusTags, which we don't care about
+	return head, packets[2:], nil
+}
+
+// Returns the duration of an Opus packet in units of 1/48000 of a second, using its TOC byte
+func opusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	var (
+		config = packet[0] >> 3
+		frame  int
+	)
+
+	switch {
+	case config < 12:
+		// SILK: 10, 20, 40 or 60ms
+		frame = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		// Hybrid: 10 or 20ms
+		frame = []int{480, 960}[config%2]
+	default:
+		// CELT: 2.5, 5, 10 or 20ms
+		frame = []int{120, 240, 480, 960}[config%4]
+	}
+
+	switch packet[0] & 0x3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return frame * 2
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return frame * int(packet[1]&0x3F)
+	}
+}
+
+// Loads the packets of an Ogg Opus file as-is, without decoding or re-encoding them. Returns
+// errUnsupportedFormat when the file isn't Opus or the packets aren't single 20ms frames at
+// 48kHz, which is what Sound.Play sends.
+func passthroughOpus(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if header, _ := r.Peek(36); sniffFormat(header) != ".opus" {
+		return nil, errUnsupportedFormat
+	}
+
+	head, packets, err := readOggOpus(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if head.MappingFamily != 0 || (head.SampleRate != 0 && head.SampleRate != SAMPLE_RATE) {
+		return nil, errUnsupportedFormat
+	}
+
+	for _, packet := range packets {
+		if opusPacketSamples(packet) != FRAME_SIZE {
+			return nil, errUnsupportedFormat
+		}
+	}
+
+	packets = skipPriming(packets, head.PreSkip)
+	if len(packets) == 0 {
+		return nil, fmt.Errorf("no audio left after the pre-skip")
+	}
+	return packets, nil
+}
+
+// Drops the leading packets that fall entirely within the encoder priming samples. Packets can't
+// be cut, so up to 20ms of priming (usually silence) at the start of a passed through sound is
+// still played, where decoding would have skipped all of it.
+func skipPriming(packets [][]byte, preSkip uint16) [][]byte {
+	skip := int(preSkip) / FRAME_SIZE
+	if skip > len(packets) {
+		skip = len(packets)
+	}
+	return packets[skip:]
+}
+
+// Decodes an Ogg Opus stream into 48kHz stereo int16 samples
+func decodeOggOpus(r io.Reader) ([]int16, error) {
+	head, packets, err := readOggOpus(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if head.MappingFamily != 0 {
+		return nil, errUnsupportedFormat
+	}
+
+	pcm, err := decodeOpusPackets(packets)
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop the encoder priming samples from the start of the stream
+	skip := int(head.PreSkip) * CHANNELS
+	if skip > len(pcm) {
+		skip = len(pcm)
+	}
+	return pcm[skip:], nil
+}
+
+// Decodes Opus packets into 48kHz stereo int16 samples
+func decodeOpusPackets(packets [][]byte) ([]int16, error) {
+	decoder, err := gopus.NewDecoder(SAMPLE_RATE, CHANNELS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decoder: %v", err)
+	}
+
+	var pcm []int16
+	for _, packet := range packets {
+		samples, err := decoder.Decode(packet, maxOpusPacketSize, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode opus packet: %v", err)
+		}
+		pcm = append(pcm, samples...)
+	}
+	return pcm, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// Returns the given number of packets that look like 20ms CELT frames to passthrough, which only
+// reads their TOC byte
+func fakeOpusPackets(count int) [][]byte {
+	var packets [][]byte
+	for i := 0; i < count; i++ {
+		packets = append(packets, []byte{31 << 3, byte(i)})
+	}
+	return packets
+}
+
+// Encodes the given number of 20ms frames of a sine wave
+func encodeTestOpus(t *testing.T, count int) [][]byte {
+	encoder, err := defaultEncoderProfile().newEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets [][]byte
+	pcm := make([]int16, FRAME_SIZE*CHANNELS)
+	for i := 0; i < count; i++ {
+		for j := range pcm {
+			pcm[j] = int16(8000 * math.Sin(2*math.Pi*440*float64(i*FRAME_SIZE+j/CHANNELS)/SAMPLE_RATE))
+		}
+
+		packet, err := encoder.Encode(pcm, FRAME_SIZE, FRAME_SIZE*CHANNELS*2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// Writes an Ogg Opus file holding the given packets, one packet per page
+func writeTestOpus(t *testing.T, path string, packets [][]byte, preSkip uint16) {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8], head[9] = 1, CHANNELS
+	binary.LittleEndian.PutUint16(head[10:], preSkip)
+	binary.LittleEndian.PutUint32(head[12:], SAMPLE_RATE)
+
+	bodies := append([][]byte{head, []byte("OpusTags")}, packets...)
+
+	var data []byte
+	for i, body := range bodies {
+		// Lacing values of 255 continue the packet into the next segment
+		var lacing []byte
+		for n := len(body); ; n -= 255 {
+			if n < 255 {
+				lacing = append(lacing, byte(n))
+				break
+			}
+			lacing = append(lacing, 255)
+		}
+
+		page := make([]byte, 27)
+		copy(page, "OggS")
+		binary.LittleEndian.PutUint32(page[14:], 1)
+		binary.LittleEndian.PutUint32(page[18:], uint32(i))
+		page[26] = byte(len(lacing))
+		page = append(page, lacing...)
+		data = append(data, append(page, body...)...)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPassthroughOpus(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "primed.opus")
+	writeTestOpus(t, path, fakeOpusPackets(3), FRAME_SIZE+312)
+	packets, err := passthroughOpus(path)
+	if err != nil {
+		t.Fatalf("passing through a primed file: %v", err)
+	}
+	if len(packets) != 2 || packets[0][1] != 1 {
+		t.Errorf("kept %d packets, want the last 2", len(packets))
+	}
+
+	// A file that's all priming has nothing to play, which must not count as loading
+	path = filepath.Join(dir, "empty.opus")
+	writeTestOpus(t, path, fakeOpusPackets(2), FRAME_SIZE*2)
+	if packets, err := passthroughOpus(path); err == nil {
+		t.Errorf("a file that's all pre-skip loaded as %d packets", len(packets))
+	}
+}
+
+func TestSkipPriming(t *testing.T) {
+	packets := make([][]byte, 4)
+	for i := range packets {
+		packets[i] = []byte{byte(i)}
+	}
+
+	tests := []struct {
+		preSkip uint16
+		first   byte
+		count   int
+	}{
+		{0, 0, 4},
+		{312, 0, 4},
+		{FRAME_SIZE, 1, 3},
+		{FRAME_SIZE*2 + 312, 2, 2},
+	}
+
+	for _, test := range tests {
+		kept := skipPriming(packets, test.preSkip)
+		if len(kept) != test.count || kept[0][0] != test.first {
+			t.Errorf("pre-skip %d kept %d packets starting at %d, want %d starting at %d",
+				test.preSkip, len(kept), kept[0][0], test.count, test.first)
+		}
+	}
+
+	if kept := skipPriming(packets, FRAME_SIZE*10); len(kept) != 0 {
+		t.Errorf("pre-skip longer than the stream kept %d packets, want none", len(kept))
+	}
+}
+
+func TestPassthroughMeasuresLoudness(t *testing.T) {
+	s := createSound("passthrough", 1, 0)
+	s.File = filepath.Join(t.TempDir(), "sine.opus")
+
+	packets := encodeTestOpus(t, 50)
+	writeTestOpus(t, s.File, packets, 0)
+
+	if err := s.Load(); err != nil {
+		t.Fatalf("loading a passthrough sound: %v", err)
+	}
+
+	if len(s.buffer) != len(packets) || string(s.buffer[10]) != string(packets[10]) {
+		t.Errorf("passthrough sound wasn't loaded as its original packets")
+	}
+
+	if s.Loudness > -10 || s.Loudness < -40 || s.LoudnessGain != 0 {
+		t.Errorf("passthrough sound measured %.1f LUFS with %.1f dB of gain, want a sine's loudness and no gain", s.Loudness, s.LoudnessGain)
+	}
+}
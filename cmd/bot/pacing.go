@@ -0,0 +1,219 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// How often discordgo sends a frame, and so how often we should hand it one
+	frameDuration = 20 * time.Millisecond
+
+	// How far ahead of schedule frames are handed over, so discordgo always has one ready
+	pacingLead = 2 * frameDuration
+
+	// How long a guild can go without playing anything before its metrics are folded into
+	// otherGuilds, so guilds that stop using the bot don't keep their own entry forever
+	metricsIdleTimeout = time.Hour
+
+	// Metrics key shared by every guild that has gone idle
+	otherGuilds = "other"
+)
+
+// Counters describing how smoothly frames were sent in a guild
+type playbackMetrics struct {
+	Frames int64
+
+	// Frames that were ready more than a frame late, meaning the voice sender went without
+	Underruns int64
+
+	// Total and worst time spent waiting for the voice sender to accept a frame
+	SendLatency    time.Duration
+	MaxSendLatency time.Duration
+
+	// Total difference between the gaps separating frames and 20ms
+	Jitter time.Duration
+
+	// Total time sounds finished behind (or ahead of, when negative) schedule, and how far off
+	// the most recent one was
+	Drift     time.Duration
+	LastDrift time.Duration
+
+	// When the most recent sound finished
+	LastPlayed time.Time
+}
+
+var (
+	// Map of Guild id's to the playback metrics for that guild
+	guildMetrics   map[string]*playbackMetrics = make(map[string]*playbackMetrics)
+	guildMetricsMu sync.Mutex
+)
+
+// Average time spent waiting for the voice sender to accept a frame
+func (m playbackMetrics) AvgSendLatency() time.Duration {
+	if m.Frames == 0 {
+		return 0
+	}
+	return m.SendLatency / time.Duration(m.Frames)
+}
+
+// Average difference between the gap separating frames and 20ms
+func (m playbackMetrics) AvgJitter() time.Duration {
+	if m.Frames == 0 {
+		return 0
+	}
+	return m.Jitter / time.Duration(m.Frames)
+}
+
+// Adds another set of metrics to this one
+func (m *playbackMetrics) add(other *playbackMetrics) {
+	m.Frames += other.Frames
+	m.Underruns += other.Underruns
+	m.SendLatency += other.SendLatency
+	m.Jitter += other.Jitter
+	m.Drift += other.Drift
+	if other.MaxSendLatency > m.MaxSendLatency {
+		m.MaxSendLatency = other.MaxSendLatency
+	}
+	if other.LastPlayed.After(m.LastPlayed) {
+		m.LastDrift = other.LastDrift
+		m.LastPlayed = other.LastPlayed
+	}
+}
+
+// Adds metrics to a guild's running totals
+func recordPlayback(guildID string, m *playbackMetrics) {
+	guildMetricsMu.Lock()
+	defer guildMetricsMu.Unlock()
+
+	total, ok := guildMetrics[guildID]
+	if !ok {
+		total = &playbackMetrics{}
+		guildMetrics[guildID] = total
+	}
+	total.add(m)
+
+	pruneMetrics(time.Now())
+}
+
+// Folds the metrics of guilds that haven't played anything within metricsIdleTimeout into
+// otherGuilds, keeping the totals intact. guildMetricsMu must be held.
+func pruneMetrics(now time.Time) {
+	for id, m := range guildMetrics {
+		if id == otherGuilds || now.Sub(m.LastPlayed) < metricsIdleTimeout {
+			continue
+		}
+
+		other, ok := guildMetrics[otherGuilds]
+		if !ok {
+			other = &playbackMetrics{}
+			guildMetrics[otherGuilds] = other
+		}
+		other.add(m)
+		delete(guildMetrics, id)
+	}
+}
+
+// Returns a copy of the metrics for every guild that has played something recently, with the
+// rest added together under otherGuilds
+func allPlaybackMetrics() map[string]playbackMetrics {
+	guildMetricsMu.Lock()
+	defer guildMetricsMu.Unlock()
+
+	pruneMetrics(time.Now())
+
+	all := make(map[string]playbackMetrics, len(guildMetrics))
+	for id, m := range guildMetrics {
+		all[id] = *m
+	}
+	return all
+}
+
+// Returns the metrics for every guild added together
+func totalPlaybackMetrics() playbackMetrics {
+	total := playbackMetrics{}
+	for _, m := range allPlaybackMetrics() {
+		total.add(&m)
+	}
+	return total
+}
+
+// Hands frames to a VoiceConnection on a steady 20ms schedule instead of as fast as it takes
+// them, measuring how well the voice sender keeps up along the way
+type framePacer struct {
+	guildID string
+	start   time.Time
+	last    time.Time
+	sent    int
+	metrics playbackMetrics
+}
+
+func newFramePacer(guildID string) *framePacer {
+	return &framePacer{guildID: guildID}
+}
+
+// Sends a frame once it's due, returning false if the stop channel closed first
+func (p *framePacer) Send(vc *discordgo.VoiceConnection, stop <-chan struct{}, frame []byte) bool {
+	now := time.Now()
+	if p.sent == 0 {
+		p.start = now
+	}
+
+	due := p.start.Add(time.Duration(p.sent) * frameDuration)
+	if wait := due.Sub(now) - pacingLead; wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return false
+		}
+	}
+
+	ready := time.Now()
+	if ready.Sub(due) > frameDuration {
+		p.metrics.Underruns++
+	}
+
+	select {
+	case vc.OpusSend <- frame:
+	case <-stop:
+		return false
+	}
+
+	sent := time.Now()
+	latency := sent.Sub(ready)
+	p.metrics.SendLatency += latency
+	if latency > p.metrics.MaxSendLatency {
+		p.metrics.MaxSendLatency = latency
+	}
+
+	if p.sent > 0 {
+		jitter := sent.Sub(p.last) - frameDuration
+		if jitter < 0 {
+			jitter = -jitter
+		}
+		p.metrics.Jitter += jitter
+	}
+
+	p.last = sent
+	p.sent++
+	p.metrics.Frames++
+	return true
+}
+
+// Records the metrics for everything sent through the pacer against its guild
+func (p *framePacer) Finish() {
+	if p.sent == 0 {
+		return
+	}
+
+	// Frames are handed over pacingLead early, so an on schedule sound finishes that far before
+	// its last frame is due
+	due := p.start.Add(time.Duration(p.sent-1) * frameDuration)
+	p.metrics.Drift = p.last.Sub(due) + pacingLead
+	p.metrics.LastDrift = p.metrics.Drift
+	p.metrics.LastPlayed = p.last
+
+	recordPlayback(p.guildID, &p.metrics)
+}
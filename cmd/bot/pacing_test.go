@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlaybackMetricsFoldIdleGuilds(t *testing.T) {
+	guildMetricsMu.Lock()
+	old := guildMetrics
+	guildMetrics = make(map[string]*playbackMetrics)
+	guildMetricsMu.Unlock()
+
+	defer func() {
+		guildMetricsMu.Lock()
+		guildMetrics = old
+		guildMetricsMu.Unlock()
+	}()
+
+	now := time.Now()
+	idle := now.Add(-2 * metricsIdleTimeout)
+
+	recordPlayback("quiet", &playbackMetrics{Frames: 10, Drift: time.Millisecond, LastDrift: time.Millisecond, LastPlayed: idle})
+	recordPlayback("gone", &playbackMetrics{Frames: 5, Underruns: 1, LastPlayed: idle})
+	recordPlayback("busy", &playbackMetrics{Frames: 3, LastDrift: -time.Millisecond, LastPlayed: now})
+
+	all := allPlaybackMetrics()
+	if len(all) != 2 {
+		t.Fatalf("got metrics for %d guilds, want busy and %s", len(all), otherGuilds)
+	}
+
+	if busy := all["busy"]; busy.Frames != 3 || busy.LastDrift != -time.Millisecond {
+		t.Errorf("busy guild has %d frames and drift %v, want 3 and -1ms", busy.Frames, busy.LastDrift)
+	}
+
+	if other := all[otherGuilds]; other.Frames != 15 || other.Underruns != 1 {
+		t.Errorf("idle guilds add up to %d frames and %d underruns, want 15 and 1", other.Frames, other.Underruns)
+	}
+
+	if total := totalPlaybackMetrics(); total.Frames != 18 {
+		t.Errorf("total frames %d after folding idle guilds, want 18", total.Frames)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// Discord's Administrator permission, which grants every other permission. discordgo doesn't
+// define it, and has Manage Roles on the same bit.
+const permissionAdministrator = 1 << 3
+
+var (
+	// Name of the role that is allowed to control playback, in addition to server managers
+	CONTROL_ROLE = "Airhorn DJ"
+)
+
+// Returns the combined guild level permissions of a user, from the roles they have
+func memberPermissions(guild *discordgo.Guild, userID string) int {
+	member, err := discord.State.Member(guild.ID, userID)
+	if err != nil {
+		return 0
+	}
+
+	permissions := 0
+	for _, role := range guild.Roles {
+		// The @everyone role shares its ID with the guild
+		if role.ID == guild.ID || scontains(role.ID, member.Roles...) {
+			permissions |= role.Permissions
+		}
+	}
+	return permissions
+}
+
+// Whether a user has a role with the given name
+func hasRoleNamed(guild *discordgo.Guild, userID, name string) bool {
+	member, err := discord.State.Member(guild.ID, userID)
+	if err != nil {
+		return false
+	}
+
+	for _, role := range guild.Roles {
+		if role.Name == name && scontains(role.ID, member.Roles...) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a user may control playback in a guild (stopping sounds, changing settings etc.)
+func canControlPlayback(guild *discordgo.Guild, userID string) bool {
+	if userID == OWNER || isServerAdmin(guild, userID) {
+		return true
+	}
+
+	return CONTROL_ROLE != "" && hasRoleNamed(guild, userID, CONTROL_ROLE)
+}
+
+// Whether a user owns a guild, is an administrator of it or can manage it
+func isServerAdmin(guild *discordgo.Guild, userID string) bool {
+	if userID == guild.OwnerID {
+		return true
+	}
+
+	return memberPermissions(guild, userID)&(permissionAdministrator|discordgo.PermissionManageServer) != 0
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestIsServerAdmin(t *testing.T) {
+	guild := &discordgo.Guild{
+		ID:      "guild",
+		OwnerID: "owner",
+		Roles: []*discordgo.Role{
+			{ID: "guild", Permissions: discordgo.PermissionSendMessages},
+			{ID: "admin", Permissions: permissionAdministrator},
+			{ID: "manager", Permissions: discordgo.PermissionManageServer},
+		},
+	}
+
+	old := discord
+	discord = &discordgo.Session{State: discordgo.NewState()}
+	defer func() {
+		discord = old
+	}()
+
+	if err := discord.State.GuildAdd(guild); err != nil {
+		t.Fatal(err)
+	}
+	for user, roles := range map[string][]string{"admin": {"admin"}, "manager": {"manager"}, "member": nil} {
+		if err := discord.State.MemberAdd(&discordgo.Member{GuildID: guild.ID, User: &discordgo.User{ID: user}, Roles: roles}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for user, want := range map[string]bool{"owner": true, "admin": true, "manager": true, "member": false} {
+		if got := isServerAdmin(guild, user); got != want {
+			t.Errorf("isServerAdmin(%s) = %v, want %v", user, got, want)
+		}
+	}
+}
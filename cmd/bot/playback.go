@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned by playSound when playback was halted with !stop
+var errPlaybackStopped = errors.New("playback stopped")
+
+var (
+	// Map of Guild id's to channels that are closed to stop whatever is playing in that guild
+	stops   map[string]chan struct{} = make(map[string]chan struct{})
+	stopsMu sync.Mutex
+)
+
+// Registers the start of playback in a guild, returning the channel that signals a stop
+func startPlayback(guildID string) <-chan struct{} {
+	stopsMu.Lock()
+	defer stopsMu.Unlock()
+
+	stop := make(chan struct{})
+	stops[guildID] = stop
+	return stop
+}
+
+// Returns the stop channel for the guild's current playback (nil if nothing is playing)
+func playbackStop(guildID string) <-chan struct{} {
+	stopsMu.Lock()
+	defer stopsMu.Unlock()
+	return stops[guildID]
+}
+
+// Signals the current playback in a guild to stop, returning false if nothing was playing
+func stopPlayback(guildID string) bool {
+	stopsMu.Lock()
+	defer stopsMu.Unlock()
+
+	stop, ok := stops[guildID]
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-stop:
+		// Already stopping
+	default:
+		close(stop)
+	}
+	return true
+}
+
+// Forgets about the playback in a guild once it's done. Only the given stop channel is removed,
+// so ending one playback late can't take the stop channel of another that started since.
+func endPlayback(guildID string, stop <-chan struct{}) {
+	stopsMu.Lock()
+	defer stopsMu.Unlock()
+
+	if stops[guildID] == stop {
+		delete(stops, guildID)
+	}
+}
+
+// Waits for the given number of milliseconds, returning false if playback was stopped first
+func sleepUnlessStopped(ms int, stop <-chan struct{}) bool {
+	if ms <= 0 {
+		return true
+	}
+
+	select {
+	case <-time.After(time.Millisecond * time.Duration(ms)):
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Whether a channel has been closed
+func closed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns a channel that's closed as soon as either a or b is, along with a function that must be
+// called once the channel is no longer needed
+func either(a, b <-chan struct{}) (<-chan struct{}, func()) {
+	var (
+		c    = make(chan struct{})
+		done = make(chan struct{})
+	)
+
+	go func() {
+		select {
+		case <-a:
+		case <-b:
+		case <-done:
+		}
+		close(c)
+	}()
+
+	return c, func() { close(done) }
+}
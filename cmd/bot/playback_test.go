@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEndPlaybackKeepsNewerStop(t *testing.T) {
+	old := startPlayback("ended")
+	current := startPlayback("ended")
+
+	// The first playback finishing late mustn't unregister the one that replaced it
+	endPlayback("ended", old)
+	if playbackStop("ended") != current {
+		t.Fatal("ending an old playback removed the current stop channel")
+	}
+
+	if !stopPlayback("ended") || !closed(current) {
+		t.Error("the current playback couldn't be stopped after an old one ended")
+	}
+
+	endPlayback("ended", current)
+	if playbackStop("ended") != nil {
+		t.Error("ending the current playback left its stop channel registered")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A sound waiting to be loaded, along with the collection it belongs to
+type soundLoad struct {
+	Collection *SoundCollection
+	Sound      *Sound
+}
+
+// Describes a sound that failed to load
+type loadError struct {
+	Collection string
+	Sound      string
+	Err        error
+
+	sound *Sound
+}
+
+func (e *loadError) Error() string {
+	return fmt.Sprintf("%s/%s: %v", e.Collection, e.Sound, e.Err)
+}
+
+// Returns a load for every sound in the given collections
+func collectionLoads(colls []*SoundCollection) []soundLoad {
+	var loads []soundLoad
+	for _, coll := range colls {
+		for _, sound := range coll.Sounds {
+			loads = append(loads, soundLoad{Collection: coll, Sound: sound})
+		}
+	}
+	return loads
+}
+
+// Loads sounds across a pool of GOMAXPROCS workers, adding each one to the store as it
+// finishes. Failures don't stop the other sounds from loading, they're returned at the end.
+func loadSounds(loads []soundLoad) []*loadError {
+	var (
+		jobs     = make(chan soundLoad)
+		workers  = runtime.GOMAXPROCS(0)
+		total    = len(loads)
+		start    = time.Now()
+		finished int64
+		failures []*loadError
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+	)
+
+	if workers > total {
+		workers = total
+	}
+
+	// Log progress roughly every 10%
+	step := int64(total / 10)
+	if step < 1 {
+		step = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for job := range jobs {
+				err := job.Sound.Load()
+				if err != nil {
+					mu.Lock()
+					failures = append(failures, &loadError{
+						Collection: job.Collection.Name,
+						Sound:      job.Sound.Name,
+						Err:        err,
+						sound:      job.Sound,
+					})
+					mu.Unlock()
+				} else {
+					store.Add(job.Sound)
+				}
+
+				if n := atomic.AddInt64(&finished, 1); n%step == 0 || n == int64(total) {
+					log.WithFields(log.Fields{
+						"loaded": n,
+						"total":  total,
+					}).Info("Loading sounds")
+				}
+			}
+		}()
+	}
+
+	for _, load := range loads {
+		jobs <- load
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, failure := range failures {
+		log.WithFields(log.Fields{
+			"collection": failure.Collection,
+			"sound":      failure.Sound,
+			"error":      failure.Err,
+		}).Error("Failed to load sound")
+	}
+
+	log.WithFields(log.Fields{
+		"total":    total,
+		"failed":   len(failures),
+		"workers":  workers,
+		"duration": time.Since(start),
+	}).Info("Finished loading sounds")
+	return failures
+}
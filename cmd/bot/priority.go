@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// How urgently a play should be played, higher priorities jump ahead in the queue
+type playPriority int
+
+const (
+	priorityNormal playPriority = iota
+	priorityAdmin
+	priorityOwner
+)
+
+var (
+	// Whether a higher priority play cuts off the lower priority sound that's playing
+	PREEMPT_PLAYS = false
+
+	// Maximum number of normal priority plays a single user can have waiting in a guild's
+	// queue, 0 for no limit
+	MAX_USER_QUEUED = 2
+)
+
+func (p playPriority) String() string {
+	switch p {
+	case priorityAdmin:
+		return "admin"
+	case priorityOwner:
+		return "owner"
+	}
+	return "normal"
+}
+
+// Returns the priority of plays requested by a user in a guild
+func priorityFor(guild *discordgo.Guild, userID string) playPriority {
+	if OWNER != "" && userID == OWNER {
+		return priorityOwner
+	}
+
+	if isServerAdmin(guild, userID) {
+		return priorityAdmin
+	}
+	return priorityNormal
+}
+
+// Returns where a play belongs in a queue. Plays are ordered by priority, and plays of the same
+// priority take turns between users so nobody jumps ahead by queueing several sounds at once.
+func queuePosition(plays []*Play, play *Play) int {
+	// How many plays this user already has waiting at this priority decides which round it's in
+	round := 0
+	for _, queued := range plays {
+		if queued.Priority == play.Priority && queued.UserID == play.UserID {
+			round++
+		}
+	}
+
+	rounds := make(map[string]int)
+	for i, queued := range plays {
+		if queued.Priority < play.Priority {
+			return i
+		}
+
+		if queued.Priority == play.Priority {
+			if rounds[queued.UserID] > round {
+				return i
+			}
+			rounds[queued.UserID]++
+		}
+	}
+	return len(plays)
+}
+
+// Counts the plays a user has waiting at a priority
+func queuedBy(plays []*Play, userID string, priority playPriority) int {
+	count := 0
+	for _, play := range plays {
+		if play.UserID == userID && play.Priority == priority {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the index of the play to drop to make room for one of the given priority, the newest
+// of the lowest priority plays below it, or -1 if every queued play is at least as important
+func evictionCandidate(plays []*Play, priority playPriority) int {
+	victim := -1
+	for i, play := range plays {
+		if play.Priority < priority && (victim == -1 || play.Priority <= plays[victim].Priority) {
+			victim = i
+		}
+	}
+	return victim
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Returns the loudness this sound should be normalized to, or 0 if it shouldn't be
+func (s *Sound) targetLoudness() float64 {
+	if s.TargetLoudness != nil {
+		return *s.TargetLoudness
+	}
+	return LOUDNESS_TARGET
+}
+
+// Returns the level below which this sound counts as silent
+func (s *Sound) silenceThreshold() float64 {
+	if s.SilenceThreshold != nil {
+		return *s.SilenceThreshold
+	}
+	return SILENCE_THRESHOLD
+}
+
+// Returns the encoder profile for this sound, with defaults filled in
+func (s *Sound) encoderProfile() *EncoderProfile {
+	return defaultEncoderProfile().merge(s.Encoder)
+}
+
+// Describes every setting that changes the encoded frames of this sound
+func (s *Sound) encodeSettings() string {
+	settings := fmt.Sprintf("%s:lufs=%g:start=%d:end=%d:gain=%g:fade=%d/%d",
+		s.encoderProfile(), s.targetLoudness(), s.Start, s.End, s.Gain, s.FadeIn, s.FadeOut)
+
+	if s.TrimSilence {
+		settings += fmt.Sprintf(":silence=%g", s.silenceThreshold())
+	}
+	if s.Effects != nil {
+		settings += fmt.Sprintf(":effects=%s", s.Effects)
+	}
+	return settings
+}
+
+// Whether this sound has to be decoded to PCM and processed before being encoded, which
+// rules out passing Opus packets straight through. Only a target_lufs set on the sound itself
+// counts here, so Opus files that can be passed through aren't normalized to LOUDNESS_TARGET.
+func (s *Sound) needsPCM() bool {
+	normalize := s.TargetLoudness != nil && *s.TargetLoudness != 0
+	return s.Encoder != nil || normalize || s.Start != 0 || s.End != 0 || s.Gain != 0 ||
+		s.FadeIn != 0 || s.FadeOut != 0 || s.TrimSilence || s.Effects != nil
+}
+
+// Runs decoded 48kHz stereo PCM through the processing stages configured for this sound
+func (s *Sound) process(pcm []int16) []int16 {
+	pcm = trimRange(pcm, s.Start, s.End)
+	if s.TrimSilence {
+		pcm = trimSilence(pcm, s.silenceThreshold())
+	}
+	if s.Effects != nil {
+		pcm = s.Effects.apply(pcm)
+	}
+
+	s.Loudness = measureLoudness(pcm)
+	s.LoudnessGain = 0
+
+	if target := s.targetLoudness(); target != 0 {
+		s.LoudnessGain = normalizationGain(pcm, s.Loudness, target)
+		applyGain(pcm, s.LoudnessGain)
+	}
+
+	applyGain(pcm, s.Gain)
+	applyFades(pcm, s.FadeIn, s.FadeOut)
+
+	s.logLoudness()
+	return pcm
+}
+
+// Measures the loudness of a sound that's played as-is, without changing its level
+func (s *Sound) measure(pcm []int16) {
+	s.Loudness = measureLoudness(pcm)
+	s.LoudnessGain = 0
+	s.logLoudness()
+}
+
+func (s *Sound) logLoudness() {
+	log.WithFields(log.Fields{
+		"sound":    s.Name,
+		"file":     s.File,
+		"loudness": fmt.Sprintf("%.1f LUFS", s.Loudness),
+		"gain":     fmt.Sprintf("%.1f dB", s.LoudnessGain),
+	}).Info("Measured sound loudness")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNeedsPCM(t *testing.T) {
+	target := -20.0
+	off := 0.0
+
+	tests := []struct {
+		name  string
+		sound *Sound
+		want  bool
+	}{
+		{"default loudness", &Sound{}, false},
+		{"explicit target", &Sound{TargetLoudness: &target}, true},
+		{"target disabled", &Sound{TargetLoudness: &off}, false},
+		{"gain", &Sound{Gain: 3}, true},
+		{"encoder profile", &Sound{Encoder: &EncoderProfile{Bitrate: 64}}, true},
+		{"trimmed", &Sound{Start: 100}, true},
+	}
+
+	for _, test := range tests {
+		if got := test.sound.needsPCM(); got != test.want {
+			t.Errorf("%s: needsPCM() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+// Where a guild's queue is in its lifecycle
+type queueState int
+
+const (
+	// Nothing is queued and the bot isn't in voice
+	queueIdle queueState = iota
+
+	// Connecting to voice for the first play
+	queueJoining
+
+	// Playing through the queue
+	queuePlaying
+
+	// The queue ran dry, waiting out the last sound's part delay before leaving voice
+	queueDraining
+
+	// Nothing is queued, but the bot is staying in voice in case another play arrives
+	queueLingering
+)
+
+func (s queueState) String() string {
+	switch s {
+	case queueJoining:
+		return "joining"
+	case queuePlaying:
+		return "playing"
+	case queueDraining:
+		return "draining"
+	case queueLingering:
+		return "lingering"
+	}
+	return "idle"
+}
+
+// A guild's pending plays, along with the worker goroutine playing them
+type guildQueue struct {
+	GuildID string
+
+	manager *queueManager
+
+	// Guarded by the manager's lock
+	state   queueState
+	plays   []*Play
+	current *Play
+	skip    chan struct{}
+
+	// Stop channel registered for the queue's current playback
+	stop <-chan struct{}
+
+	// Set when the current play was skipped for a higher priority one, so nothing chained
+	// after it gets played either
+	preempted bool
+
+	// Signalled when a play is added, so a lingering worker can pick it up
+	wake chan struct{}
+
+	// Only used by the worker goroutine
+	vc *discordgo.VoiceConnection
+}
+
+// Owns the queue for every guild, starting a worker goroutine when a guild's first play arrives
+// and removing the queue once the worker has played everything and left voice
+type queueManager struct {
+	sync.Mutex
+
+	guilds map[string]*guildQueue
+
+	// Maximum number of plays waiting in a guild's queue, not counting the one playing
+	size int
+
+	// Joins and leaves voice channels, and checks whether anyone's still listening in one the
+	// bot is lingering in. Swappable so the manager can be run without Discord.
+	join     func(guildID, channelID string) (*discordgo.VoiceConnection, error)
+	leave    func(vc *discordgo.VoiceConnection)
+	occupied func(vc *discordgo.VoiceConnection) bool
+}
+
+// Queues for every guild playing sounds
+var queues = newQueueManager(MAX_QUEUE_SIZE)
+
+func newQueueManager(size int) *queueManager {
+	return &queueManager{
+		guilds: make(map[string]*guildQueue),
+		size:   size,
+		join: func(guildID, channelID string) (*discordgo.VoiceConnection, error) {
+			return discord.ChannelVoiceJoin(guildID, channelID, false, false)
+		},
+		leave: func(vc *discordgo.VoiceConnection) {
+			vc.Disconnect()
+		},
+		occupied: voiceOccupied,
+	}
+}
+
+// Adds a play to its guild's queue, starting a worker for the guild if it doesn't have one.
+// Higher priority plays jump ahead of lower ones, and can push the newest low priority play
+// out of a full queue. Returns false if the play was dropped because the queue is full or
+// the user already has as many plays waiting as they're allowed.
+func (m *queueManager) Enqueue(play *Play) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	q, ok := m.guilds[play.GuildID]
+	if !ok {
+		q = &guildQueue{
+			GuildID: play.GuildID,
+			manager: m,
+			state:   queueJoining,
+			wake:    make(chan struct{}, 1),
+		}
+		m.guilds[play.GuildID] = q
+
+		q.stop = startPlayback(play.GuildID)
+		go q.run()
+	} else if !m.makeRoom(q, play) {
+		return false
+	}
+
+	i := queuePosition(q.plays, play)
+	q.plays = append(q.plays, nil)
+	copy(q.plays[i+1:], q.plays[i:])
+	q.plays[i] = play
+
+	if PREEMPT_PLAYS && q.current != nil && q.current.Priority < play.Priority && !closed(q.skip) {
+		q.preempted = true
+		close(q.skip)
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Checks a play can be added to a queue, dropping a lower priority play if the queue is full
+func (m *queueManager) makeRoom(q *guildQueue, play *Play) bool {
+	if play.Priority == priorityNormal && MAX_USER_QUEUED > 0 && queuedBy(q.plays, play.UserID, priorityNormal) >= MAX_USER_QUEUED {
+		return false
+	}
+
+	if len(q.plays) < m.size {
+		return true
+	}
+
+	victim := evictionCandidate(q.plays, play.Priority)
+	if victim == -1 {
+		return false
+	}
+
+	q.plays = append(q.plays[:victim], q.plays[victim+1:]...)
+	return true
+}
+
+// Whether a guild has a queue that's playing or about to
+func (m *queueManager) Active(guildID string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	_, ok := m.guilds[guildID]
+	return ok
+}
+
+// Returns the state of a guild's queue
+func (m *queueManager) State(guildID string) queueState {
+	m.Lock()
+	defer m.Unlock()
+
+	if q, ok := m.guilds[guildID]; ok {
+		return q.state
+	}
+	return queueIdle
+}
+
+// Returns what a guild is playing and what's waiting in its queue
+func (m *queueManager) Snapshot(guildID string) (current *Play, plays []*Play, state queueState) {
+	m.Lock()
+	defer m.Unlock()
+
+	q, ok := m.guilds[guildID]
+	if !ok {
+		return nil, nil, queueIdle
+	}
+
+	return q.current, append([]*Play(nil), q.plays...), q.state
+}
+
+// Ends the sound a guild is playing and moves on to the next one, returning false if nothing
+// was playing
+func (m *queueManager) Skip(guildID string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	q, ok := m.guilds[guildID]
+	if !ok || q.current == nil || closed(q.skip) {
+		return false
+	}
+
+	close(q.skip)
+	return true
+}
+
+// Drops everything waiting in a guild's queue (leaving the current sound playing), returning
+// how many plays were dropped
+func (m *queueManager) Clear(guildID string) int {
+	m.Lock()
+	defer m.Unlock()
+
+	q, ok := m.guilds[guildID]
+	if !ok {
+		return 0
+	}
+
+	dropped := len(q.plays)
+	q.plays = nil
+	return dropped
+}
+
+// Records the play a queue has started, returning the channel closed if it's skipped
+func (m *queueManager) setCurrent(q *guildQueue, play *Play) <-chan struct{} {
+	m.Lock()
+	defer m.Unlock()
+
+	q.current = play
+	q.skip = make(chan struct{})
+	q.preempted = false
+	return q.skip
+}
+
+// Whether the current play was skipped to make way for a higher priority one
+func (m *queueManager) wasPreempted(q *guildQueue) bool {
+	m.Lock()
+	defer m.Unlock()
+	return q.preempted
+}
+
+// Removes and returns the next play in a queue, or nil if it's empty
+func (m *queueManager) pop(q *guildQueue) *Play {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(q.plays) == 0 {
+		return nil
+	}
+
+	play := q.plays[0]
+	q.plays = q.plays[1:]
+	return play
+}
+
+// Drops everything waiting in a queue
+func (m *queueManager) clear(q *guildQueue) {
+	m.Lock()
+	defer m.Unlock()
+	q.plays = nil
+}
+
+func (m *queueManager) setState(q *guildQueue, state queueState) {
+	m.Lock()
+	defer m.Unlock()
+	q.state = state
+}
+
+// Called by a worker after leaving voice. If nothing was queued in the meantime the queue is
+// removed and true is returned, otherwise the worker should go round again.
+func (m *queueManager) finish(q *guildQueue) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(q.plays) > 0 {
+		// Playback might have been stopped, so start afresh for whatever arrived since
+		q.state = queueJoining
+		q.stop = startPlayback(q.GuildID)
+		return false
+	}
+
+	q.state = queueIdle
+	delete(m.guilds, q.GuildID)
+	endPlayback(q.GuildID, q.stop)
+	return true
+}
+
+// Worker goroutine for a guild, plays through the queue until it's empty
+func (q *guildQueue) run() {
+	for {
+		q.playAll()
+		if q.manager.finish(q) {
+			return
+		}
+	}
+}
+
+// Plays everything in the queue, then leaves voice once the guild's idle timeout is up
+func (q *guildQueue) playAll() {
+	play, skip := q.manager.pop(q), 0
+	for play != nil {
+		next, used, err := q.playSound(play, skip)
+		if err != nil {
+			// Whether we were stopped or couldn't join, drop everything else that was queued
+			q.manager.setCurrent(q, nil)
+			q.manager.clear(q)
+			break
+		}
+
+		last := play
+		play, skip = next, used
+		if play == nil {
+			// Anything queued during the part delay still gets played before we leave
+			q.manager.setCurrent(q, nil)
+			q.manager.setState(q, queueDraining)
+			time.Sleep(time.Millisecond * time.Duration(last.Sound.PartDelay))
+			play = q.manager.pop(q)
+			if play == nil {
+				play = q.linger()
+			}
+		}
+	}
+
+	if q.vc != nil {
+		q.manager.leave(q.vc)
+		q.vc = nil
+	}
+}
+
+// Describes a play and the sounds chained after it, like "fourtap (!airhorn) then one (!anotha)"
+func describePlay(play *Play) string {
+	var parts []string
+	for ; play != nil; play = play.Next {
+		desc := play.Sound.Name
+		if play.Collection != nil {
+			command := play.Collection.Name
+			if len(play.Collection.Commands) > 0 {
+				command = play.Collection.Commands[0]
+			}
+			desc = fmt.Sprintf("%s (%s)", desc, command)
+		}
+
+		if play.Sound.Effects != nil {
+			desc = fmt.Sprintf("%s [%s]", desc, play.Sound.Effects)
+		}
+		parts = append(parts, desc)
+	}
+	return strings.Join(parts, " then ")
+}
+
+// Returns the name of the user who requested a play
+func requesterName(guild *discordgo.Guild, userID string) string {
+	member, err := discord.State.Member(guild.ID, userID)
+	if err != nil || member.User == nil {
+		return userID
+	}
+	return member.User.Username
+}
+
+// Describes who requested a play, noting if they jumped the queue
+func describeRequester(guild *discordgo.Guild, play *Play) string {
+	name := requesterName(guild, play.UserID)
+	if play.Priority != priorityNormal {
+		name = fmt.Sprintf("%s (%s priority)", name, play.Priority)
+	}
+	return name
+}
+
+// Lists what a guild is playing and what's waiting in its queue
+func handleQueueCommand(s *discordgo.Session, channel *discordgo.Channel, guild *discordgo.Guild) {
+	current, plays, _ := queues.Snapshot(guild.ID)
+	if current == nil && len(plays) == 0 {
+		s.ChannelMessageSend(channel.ID, "Nothing is queued")
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if current != nil {
+		fmt.Fprintf(buf, "Now playing: %s, requested by %s\n", describePlay(current), describeRequester(guild, current))
+	}
+
+	for i, play := range plays {
+		fmt.Fprintf(buf, "%d. %s, requested by %s\n", i+1, describePlay(play), describeRequester(guild, play))
+	}
+
+	fmt.Fprintf(buf, "%d of %d queue slots used", len(plays), queues.size)
+	s.ChannelMessageSend(channel.ID, buf.String())
+}
+
+// Skips the current sound or clears the queue, if the user is allowed to control playback
+func handleQueueControlCommand(s *discordgo.Session, channel *discordgo.Channel, guild *discordgo.Guild, user *discordgo.User, command string) {
+	if !canControlPlayback(guild, user.ID) {
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("Only server managers and the %v role can use %s", CONTROL_ROLE, command))
+		return
+	}
+
+	switch command {
+	case "!skip":
+		if !queues.Skip(guild.ID) {
+			s.ChannelMessageSend(channel.ID, "Nothing is playing")
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"user":  user.ID,
+		}).Info("Skipping sound")
+	case "!clear":
+		dropped := queues.Clear(guild.ID)
+
+		log.WithFields(log.Fields{
+			"guild":   guild.ID,
+			"user":    user.ID,
+			"dropped": dropped,
+		}).Info("Cleared queue")
+
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("Cleared %d queued sounds", dropped))
+	}
+}
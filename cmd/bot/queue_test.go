@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Stands in for Discord voice, recording joins and leaves and which plays were heard
+type testVoice struct {
+	sync.Mutex
+
+	// Guilds with an open connection
+	open map[string]bool
+
+	joins       int
+	leaves      int
+	doubleJoins int
+
+	// Frames heard for each play, by play id
+	heard map[uint32]int
+	next  uint32
+
+	// Closed once everything sent over a connection has been counted
+	drained map[*discordgo.VoiceConnection]chan struct{}
+
+	// If set, joins wait for it to be closed
+	gate chan struct{}
+}
+
+// Returns a queue manager whose voice connections are stubbed out by a testVoice
+func newTestQueueManager(size int) (*queueManager, *testVoice) {
+	v := &testVoice{
+		open:    make(map[string]bool),
+		heard:   make(map[uint32]int),
+		drained: make(map[*discordgo.VoiceConnection]chan struct{}),
+	}
+
+	m := newQueueManager(size)
+	m.join = func(guildID, channelID string) (*discordgo.VoiceConnection, error) {
+		v.Lock()
+		if v.open[guildID] {
+			v.doubleJoins++
+		}
+		v.open[guildID] = true
+		v.joins++
+		gate := v.gate
+		v.Unlock()
+
+		if gate != nil {
+			<-gate
+		}
+
+		vc := &discordgo.VoiceConnection{
+			GuildID:   guildID,
+			ChannelID: channelID,
+			OpusSend:  make(chan []byte),
+			Ready:     true,
+		}
+
+		drained := make(chan struct{})
+		v.Lock()
+		v.drained[vc] = drained
+		v.Unlock()
+
+		go func() {
+			defer close(drained)
+			for frame := range vc.OpusSend {
+				v.Lock()
+				v.heard[binary.BigEndian.Uint32(frame)]++
+				v.Unlock()
+			}
+		}()
+		return vc, nil
+	}
+	m.leave = func(vc *discordgo.VoiceConnection) {
+		v.Lock()
+		v.open[vc.GuildID] = false
+		v.leaves++
+		drained := v.drained[vc]
+		v.Unlock()
+
+		close(vc.OpusSend)
+		<-drained
+	}
+	m.occupied = func(vc *discordgo.VoiceConnection) bool {
+		return true
+	}
+	return m, v
+}
+
+// Creates a play of a sound whose frames identify the play, returning it and its id
+func (v *testVoice) play(guildID string, frames int) (*Play, uint32) {
+	v.Lock()
+	v.next++
+	id := v.next
+	v.Unlock()
+
+	frame := make([]byte, 4)
+	binary.BigEndian.PutUint32(frame, id)
+
+	s := createSound(fmt.Sprint(id), 1, 0)
+	for i := 0; i < frames; i++ {
+		s.buffer = append(s.buffer, frame)
+	}
+	store.Add(s)
+
+	return &Play{GuildID: guildID, ChannelID: "voice", UserID: fmt.Sprint(id), Sound: s}, id
+}
+
+// Waits for a condition to become true, failing the test if it takes too long
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Sets the queue options for a test, putting them back once it's done
+func withQueueOptions(t *testing.T, idle, userQueued int) {
+	oldIdle, oldQueued := IDLE_TIMEOUT, MAX_USER_QUEUED
+	IDLE_TIMEOUT, MAX_USER_QUEUED = idle, userQueued
+	t.Cleanup(func() {
+		IDLE_TIMEOUT, MAX_USER_QUEUED = oldIdle, oldQueued
+	})
+}
+
+func TestQueueStates(t *testing.T) {
+	withQueueOptions(t, 0, 0)
+	m, v := newTestQueueManager(6)
+	v.gate = make(chan struct{})
+
+	play, _ := v.play("states", 10)
+	play.Sound.PartDelay = 200
+
+	if state := m.State("states"); state != queueIdle {
+		t.Fatalf("state before the first play is %v, want idle", state)
+	}
+
+	m.Enqueue(play)
+	waitFor(t, "joining", func() bool { return m.State("states") == queueJoining })
+
+	close(v.gate)
+	waitFor(t, "playing", func() bool { return m.State("states") == queuePlaying })
+
+	waitFor(t, "current play", func() bool {
+		current, _, _ := m.Snapshot("states")
+		return current == play
+	})
+
+	waitFor(t, "draining", func() bool { return m.State("states") == queueDraining })
+	waitFor(t, "idle", func() bool { return !m.Active("states") })
+
+	if state := m.State("states"); state != queueIdle {
+		t.Errorf("state after the queue finished is %v, want idle", state)
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if v.joins != 1 || v.leaves != 1 {
+		t.Errorf("joined %d times and left %d times, want once each", v.joins, v.leaves)
+	}
+}
+
+func TestQueueLingers(t *testing.T) {
+	withQueueOptions(t, 1, 0)
+	m, v := newTestQueueManager(6)
+
+	first, _ := v.play("linger", 2)
+	m.Enqueue(first)
+	waitFor(t, "lingering", func() bool { return m.State("linger") == queueLingering })
+
+	// A play arriving while lingering reuses the connection
+	second, id := v.play("linger", 2)
+	m.Enqueue(second)
+	waitFor(t, "second play", func() bool {
+		v.Lock()
+		defer v.Unlock()
+		return v.heard[id] == 2
+	})
+
+	waitFor(t, "idle timeout", func() bool { return !m.Active("linger") })
+
+	v.Lock()
+	defer v.Unlock()
+	if v.joins != 1 || v.leaves != 1 {
+		t.Errorf("joined %d times and left %d times, want once each", v.joins, v.leaves)
+	}
+}
+
+// Frames in each play made by hammerQueues, long enough that skips have something to cut short
+const hammerFrames = 5
+
+// Enqueues plays into several guilds at once, calling control (if set) after each one, and
+// returns the ids of the plays that were accepted and rejected
+func hammerQueues(t *testing.T, m *queueManager, v *testVoice, guilds []string, control func(guildID string, i int)) (accepted, rejected []uint32) {
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+
+	for _, guildID := range guilds {
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(guildID string) {
+				defer wg.Done()
+				for i := 0; i < 10; i++ {
+					play, id := v.play(guildID, hammerFrames)
+					ok := m.Enqueue(play)
+
+					mu.Lock()
+					if ok {
+						accepted = append(accepted, id)
+					} else {
+						rejected = append(rejected, id)
+					}
+					mu.Unlock()
+
+					m.Snapshot(guildID)
+					if control != nil {
+						control(guildID, i)
+					}
+					time.Sleep(time.Duration(i%3) * 10 * time.Millisecond)
+				}
+			}(guildID)
+		}
+	}
+	wg.Wait()
+
+	for _, guildID := range guilds {
+		guildID := guildID
+		waitFor(t, guildID+" to finish", func() bool { return !m.Active(guildID) })
+	}
+	return accepted, rejected
+}
+
+// Checks every guild left voice once for each time it joined, and nothing played twice or
+// played after being rejected
+func checkQueues(t *testing.T, v *testVoice, rejected []uint32) {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.doubleJoins > 0 {
+		t.Errorf("joined a guild that already had a connection %d times", v.doubleJoins)
+	}
+
+	if v.joins != v.leaves {
+		t.Errorf("joined %d times but left %d times", v.joins, v.leaves)
+	}
+
+	for id, frames := range v.heard {
+		if frames > hammerFrames {
+			t.Errorf("play %d sent %d frames, it was played more than once", id, frames)
+		}
+	}
+
+	for _, id := range rejected {
+		if v.heard[id] > 0 {
+			t.Errorf("rejected play %d was played", id)
+		}
+	}
+}
+
+func TestQueueConcurrentEnqueue(t *testing.T) {
+	withQueueOptions(t, 0, 0)
+	m, v := newTestQueueManager(6)
+
+	guilds := []string{"a", "b", "c", "d", "e"}
+	accepted, rejected := hammerQueues(t, m, v, guilds, nil)
+	checkQueues(t, v, rejected)
+
+	if len(rejected) == 0 {
+		t.Error("no plays were rejected, the queues never filled up")
+	}
+
+	// Without skips or clears every accepted play is heard in full
+	v.Lock()
+	defer v.Unlock()
+	for _, id := range accepted {
+		if v.heard[id] != hammerFrames {
+			t.Errorf("accepted play %d sent %d frames, want %d", id, v.heard[id], hammerFrames)
+		}
+	}
+}
+
+func TestQueueConcurrentControl(t *testing.T) {
+	withQueueOptions(t, 0, 0)
+	m, v := newTestQueueManager(6)
+
+	var (
+		mu      sync.Mutex
+		skipped int
+		cleared int
+	)
+
+	guilds := []string{"f", "g", "h", "i", "j"}
+	accepted, rejected := hammerQueues(t, m, v, guilds, func(guildID string, i int) {
+		var (
+			skip    bool
+			dropped int
+		)
+		if i%3 == 1 {
+			skip = m.Skip(guildID)
+		}
+		if i%5 == 4 {
+			dropped = m.Clear(guildID)
+		}
+
+		mu.Lock()
+		if skip {
+			skipped++
+		}
+		cleared += dropped
+		mu.Unlock()
+	})
+	checkQueues(t, v, rejected)
+
+	// Every accepted play was either heard, cleared from the queue or skipped before it sent
+	// anything
+	v.Lock()
+	defer v.Unlock()
+
+	heard := 0
+	for _, id := range accepted {
+		if v.heard[id] > 0 {
+			heard++
+		}
+	}
+
+	if heard == 0 || skipped == 0 || cleared == 0 {
+		t.Errorf("expected a mix of outcomes, got %d heard, %d cleared and %d skipped", heard, cleared, skipped)
+	}
+
+	if lost := len(accepted) - heard - cleared - skipped; lost > 0 {
+		t.Errorf("%d plays were lost (%d accepted, %d heard, %d cleared, %d skipped)", lost, len(accepted), heard, cleared, skipped)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// Guards COLLECTIONS so a reload can swap the whole library at once
+	collectionsMu sync.RWMutex
+
+	// Only one reload may run at a time
+	reloadMu sync.Mutex
+)
+
+// Describes the state of a sound's source file when it was last encoded
+type sourceStamp struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Returns the current collections, safe to call while a reload is happening
+func getCollections() []*SoundCollection {
+	collectionsMu.RLock()
+	defer collectionsMu.RUnlock()
+	return COLLECTIONS
+}
+
+// Atomically replaces the current collections
+func setCollections(colls []*SoundCollection) {
+	collectionsMu.Lock()
+	COLLECTIONS = colls
+	collectionsMu.Unlock()
+}
+
+// Reads the stamp for a sound's source file
+func statSource(path string) (sourceStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return sourceStamp{}, err
+	}
+	return sourceStamp{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Returns the frames of a previously loaded sound if they can be reused for this one
+func (s *Sound) reusableFrames(old *Sound) ([][]byte, bool) {
+	if old == nil || old.File != s.File || old.encodeSettings() != s.encodeSettings() {
+		return nil, false
+	}
+
+	frames, ok := old.loadedFrames()
+	if !ok {
+		return nil, false
+	}
+
+	stamp, err := statSource(s.File)
+	if err != nil || stamp != old.source {
+		return nil, false
+	}
+	return frames, true
+}
+
+// Returns the frames of a sound if it's loaded
+func (s *Sound) loadedFrames() ([][]byte, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	frames, ok := store.Peek(s)
+	if !ok || len(frames) == 0 {
+		return nil, false
+	}
+	return frames, true
+}
+
+// Takes over the frames of a previously loaded sound, along with what was measured about them
+func (s *Sound) adopt(old *Sound, frames [][]byte) {
+	s.buffer = frames
+	s.source = old.source
+	s.Loudness = old.Loudness
+	s.LoudnessGain = old.LoudnessGain
+	store.Add(s)
+}
+
+// Removes sounds that failed to load from their collections, along with any collection left
+// with no sounds and any chain rule that would pick from one of them
+func dropSounds(colls []*SoundCollection, dropped map[*Sound]bool) []*SoundCollection {
+	if len(dropped) == 0 {
+		return colls
+	}
+
+	var (
+		kept    []*SoundCollection
+		emptied = make(map[*SoundCollection]bool)
+	)
+	for _, coll := range colls {
+		sounds := coll.Sounds[:0]
+		coll.soundRange = 0
+		for _, sound := range coll.Sounds {
+			if dropped[sound] {
+				continue
+			}
+			sounds = append(sounds, sound)
+			coll.soundRange += sound.Weight
+		}
+		coll.Sounds = sounds
+
+		if len(sounds) == 0 {
+			log.WithFields(log.Fields{
+				"collection": coll.Name,
+			}).Warning("Dropping collection with no sounds left to play")
+			emptied[coll] = true
+			continue
+		}
+		kept = append(kept, coll)
+	}
+
+	for _, coll := range kept {
+		rules := coll.Chains[:0]
+		for _, rule := range coll.Chains {
+			if emptied[rule.Collection] || dropped[rule.Sound] {
+				continue
+			}
+			rules = append(rules, rule)
+		}
+		coll.Chains = rules
+	}
+	return kept
+}
+
+// Reloads the sound manifest, re-encoding only the sounds whose source files changed. Plays
+// that are playing or queued keep a reference to the old sounds and play their buffers, which
+// are freed once those plays are done. When the store has a memory budget, changed sounds are
+// left to load on their next play. A sound that fails to load keeps its previous version if it
+// had one and is dropped otherwise, so one bad file doesn't hold back the rest of the library.
+func reloadSounds(path string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	colls, err := loadManifest(path)
+	if err != nil {
+		return err
+	}
+
+	var old []*Sound
+	previous := make(map[string]*Sound)
+	for _, coll := range getCollections() {
+		for _, sound := range coll.Sounds {
+			previous[sound.File] = sound
+			old = append(old, sound)
+		}
+	}
+
+	var (
+		changed []soundLoad
+		reused  int
+	)
+	for _, load := range collectionLoads(colls) {
+		sound, prev := load.Sound, previous[load.Sound.File]
+
+		if frames, ok := sound.reusableFrames(prev); ok {
+			sound.adopt(prev, frames)
+			reused++
+			continue
+		}
+
+		if store.budget == 0 {
+			changed = append(changed, load)
+		}
+	}
+
+	var (
+		failures = loadSounds(changed)
+		dropped  = make(map[*Sound]bool)
+	)
+	for _, failure := range failures {
+		sound, prev := failure.sound, previous[failure.sound.File]
+
+		if frames, ok := prev.loadedFrames(); ok {
+			log.WithFields(log.Fields{
+				"collection": failure.Collection,
+				"sound":      failure.Sound,
+				"error":      failure.Err,
+			}).Warning("Keeping previous version of sound that failed to reload")
+			sound.adopt(prev, frames)
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"collection": failure.Collection,
+			"sound":      failure.Sound,
+			"error":      failure.Err,
+		}).Error("Dropping sound that failed to reload")
+		sound.buffer = nil
+		dropped[sound] = true
+	}
+
+	setCollections(dropSounds(colls, dropped))
+	store.Forget(old)
+
+	log.WithFields(log.Fields{
+		"manifest": path,
+		"reused":   reused,
+		"encoded":  len(changed) - len(failures),
+		"kept":     len(failures) - len(dropped),
+		"dropped":  len(dropped),
+	}).Info("Reloaded sounds")
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes a manifest with one collection per file, chaining the first collection into the last
+func writeTestManifest(t *testing.T, dir string, files ...string) string {
+	manifest := `{"collections": [`
+	for i, file := range files {
+		if i > 0 {
+			manifest += ","
+		}
+		manifest += fmt.Sprintf(`{"name": "c%d", "commands": ["!c%d"], "sounds": [{"name": "s", "weight": 1, "file": %q}]`, i, i, file)
+		if i == 0 && len(files) > 1 {
+			manifest += fmt.Sprintf(`, "chains": [{"collection": "c%d"}]`, len(files)-1)
+		}
+		manifest += "}"
+	}
+	manifest += "]}"
+
+	path := filepath.Join(dir, "sounds.json")
+	if err := ioutil.WriteFile(path, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Returns the frames of the sound in each current collection, by collection name
+func loadedCollections() map[string][][]byte {
+	loaded := make(map[string][][]byte)
+	for _, coll := range getCollections() {
+		loaded[coll.Name], _ = store.Peek(coll.Sounds[0])
+	}
+	return loaded
+}
+
+func TestReloadSurvivesBadSounds(t *testing.T) {
+	oldColls, oldStore := getCollections(), store
+	setCollections(nil)
+	store = newSoundStore(0)
+	defer func() {
+		setCollections(oldColls)
+		store = oldStore
+	}()
+
+	dir := t.TempDir()
+	good, flaky, missing := filepath.Join(dir, "good.wav"), filepath.Join(dir, "flaky.wav"), filepath.Join(dir, "missing.wav")
+	writeTestWAV(t, good, SAMPLE_RATE, CHANNELS, 0.2)
+	writeTestWAV(t, flaky, SAMPLE_RATE, CHANNELS, 0.2)
+
+	// A sound that never loaded is dropped, taking its collection and the chain into it along
+	manifest := writeTestManifest(t, dir, good, flaky, missing)
+	if err := reloadSounds(manifest); err != nil {
+		t.Fatalf("reload with a missing file failed: %v", err)
+	}
+
+	loaded := loadedCollections()
+	if len(loaded) != 2 || len(loaded["c0"]) == 0 || len(loaded["c1"]) == 0 {
+		t.Fatalf("got collections %v after the first reload, want c0 and c1 loaded", loaded)
+	}
+	if chains := getCollections()[0].Chains; len(chains) != 0 {
+		t.Errorf("c0 still has %d chains into the dropped collection", len(chains))
+	}
+	flakyFrames := loaded["c1"]
+
+	// A sound that loaded before keeps its old frames when it fails to load again
+	if err := os.Remove(flaky); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadSounds(writeTestManifest(t, dir, good, flaky)); err != nil {
+		t.Fatalf("reload with a removed file failed: %v", err)
+	}
+
+	loaded = loadedCollections()
+	if len(loaded) != 2 || len(loaded["c1"]) != len(flakyFrames) {
+		t.Errorf("c1 has %d frames after its file was removed, want the previous %d", len(loaded["c1"]), len(flakyFrames))
+	}
+}
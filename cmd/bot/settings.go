@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// GuildSettings holds the per-guild options users can change with commands
+type GuildSettings struct {
+	// Playback volume as a percentage, 0-200
+	Volume int
+
+	// Whether overlapping plays are mixed together instead of queued
+	Mix bool
+
+	// Seconds to stay in voice after the queue empties, -1 uses IDLE_TIMEOUT
+	Idle int
+}
+
+var (
+	// Cache of settings we've already loaded, keyed by guild id
+	guildSettings   map[string]*GuildSettings = make(map[string]*GuildSettings)
+	guildSettingsMu sync.Mutex
+)
+
+// Returns the settings for a guild that hasn't changed anything
+func defaultGuildSettings() *GuildSettings {
+	return &GuildSettings{
+		Volume: 100,
+		Idle:   -1,
+	}
+}
+
+// Converts the settings into a redis hash
+func (gs *GuildSettings) toMap() map[string]string {
+	return map[string]string{
+		"volume": strconv.Itoa(gs.Volume),
+		"mix":    strconv.FormatBool(gs.Mix),
+		"idle":   strconv.Itoa(gs.Idle),
+	}
+}
+
+// Fills the settings in from a redis hash, ignoring anything missing or malformed
+func (gs *GuildSettings) fromMap(values map[string]string) {
+	if v, err := strconv.Atoi(values["volume"]); err == nil {
+		gs.Volume = v
+	}
+	if v, err := strconv.ParseBool(values["mix"]); err == nil {
+		gs.Mix = v
+	}
+	if v, err := strconv.Atoi(values["idle"]); err == nil {
+		gs.Idle = v
+	}
+}
+
+func guildSettingsKey(guildID string) string {
+	return fmt.Sprintf("airhorn:guild:%s:settings", guildID)
+}
+
+// Returns the settings for a guild, loading them from redis the first time
+func getGuildSettings(guildID string) GuildSettings {
+	guildSettingsMu.Lock()
+	defer guildSettingsMu.Unlock()
+	return *loadGuildSettings(guildID)
+}
+
+// Applies a change to a guild's settings and persists them, returning the new settings
+func updateGuildSettings(guildID string, update func(*GuildSettings)) GuildSettings {
+	guildSettingsMu.Lock()
+	defer guildSettingsMu.Unlock()
+
+	gs := loadGuildSettings(guildID)
+	update(gs)
+
+	if rcli != nil {
+		err := rcli.HMSetMap(guildSettingsKey(guildID), gs.toMap()).Err()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"guild": guildID,
+				"error": err,
+			}).Warning("Failed to save guild settings to redis")
+		}
+	}
+
+	return *gs
+}
+
+// Returns the cached settings for a guild, loading them if needed. Must hold guildSettingsMu.
+func loadGuildSettings(guildID string) *GuildSettings {
+	if gs, ok := guildSettings[guildID]; ok {
+		return gs
+	}
+
+	gs := defaultGuildSettings()
+	if rcli != nil {
+		values, err := rcli.HGetAllMap(guildSettingsKey(guildID)).Result()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"guild": guildID,
+				"error": err,
+			}).Warning("Failed to load guild settings from redis")
+		} else {
+			gs.fromMap(values)
+		}
+	}
+
+	guildSettings[guildID] = gs
+	return gs
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Keeps the encoded frames of recently played sounds in memory, loading sounds on first use
+// and evicting the least recently used ones once the byte budget is exceeded
+type soundStore struct {
+	sync.Mutex
+
+	// Maximum number of bytes of frames to keep loaded, 0 keeps everything
+	budget int64
+	used   int64
+
+	lru   *list.List
+	items map[*Sound]*list.Element
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// Point in time counters for a soundStore
+type soundStoreStats struct {
+	Sounds    int
+	Bytes     int64
+	Budget    int64
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+// Store holding the frames for every sound the bot plays
+var store = newSoundStore(0)
+
+func newSoundStore(budget int64) *soundStore {
+	return &soundStore{
+		budget: budget,
+		lru:    list.New(),
+		items:  make(map[*Sound]*list.Element),
+	}
+}
+
+// Returns the encoded frames for a sound, loading it from disk (or the cache) if needed
+func (st *soundStore) Frames(s *Sound) ([][]byte, error) {
+	if frames, ok := st.lookup(s, true); ok {
+		return frames, nil
+	}
+
+	// Only let one goroutine load a given sound, everyone else waits for it
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+
+	if frames, ok := st.lookup(s, false); ok {
+		return frames, nil
+	}
+
+	// Replaced sounds keep their frames for the plays that still reference them
+	if st.isRetired(s) && len(s.buffer) > 0 {
+		return s.buffer, nil
+	}
+
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+
+	// Once the sound is added another load can evict it and clear its buffer, so hold on to the
+	// frames before handing it over. Replaced sounds that had already been evicted end up loaded
+	// from whatever is on disk now, but aren't tracked again.
+	frames := s.buffer
+	st.Add(s)
+	return frames, nil
+}
+
+// Looks a sound up, marking it as recently used
+func (st *soundStore) lookup(s *Sound, count bool) ([][]byte, bool) {
+	st.Lock()
+	defer st.Unlock()
+
+	el, ok := st.items[s]
+	if count {
+		if ok {
+			st.hits++
+		} else {
+			st.misses++
+		}
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	st.lru.MoveToFront(el)
+	return s.buffer, true
+}
+
+// Whether a sound has been replaced and is no longer tracked
+func (st *soundStore) isRetired(s *Sound) bool {
+	st.Lock()
+	defer st.Unlock()
+	return s.retired
+}
+
+// Returns the frames for a sound only if it's already loaded
+func (st *soundStore) Peek(s *Sound) ([][]byte, bool) {
+	st.Lock()
+	defer st.Unlock()
+
+	if _, ok := st.items[s]; !ok {
+		return nil, false
+	}
+	return s.buffer, true
+}
+
+// Tracks a sound whose buffer was just filled, evicting others if we're over budget
+func (st *soundStore) Add(s *Sound) {
+	st.Lock()
+	defer st.Unlock()
+
+	if _, ok := st.items[s]; ok || s.retired {
+		return
+	}
+
+	st.items[s] = st.lru.PushFront(s)
+	st.used += bufferSize(s.buffer)
+
+	for st.budget > 0 && st.used > st.budget && st.lru.Len() > 1 {
+		evicted := st.remove(st.lru.Back())
+		st.evictions++
+
+		// Plays in progress hold their own reference to the frames, so this is safe
+		evicted.buffer = nil
+	}
+}
+
+// Stops tracking the given sounds (and their effect variants), used when they're replaced. Their
+// frames aren't cleared, since queued plays may still reference the sounds, and are freed once
+// the last of those plays is done with them.
+func (st *soundStore) Forget(sounds []*Sound) {
+	var variants []*Sound
+	for _, s := range sounds {
+		variants = append(variants, s.effectVariants()...)
+	}
+
+	st.Lock()
+	defer st.Unlock()
+
+	for _, group := range [][]*Sound{sounds, variants} {
+		for _, s := range group {
+			s.retired = true
+			if el, ok := st.items[s]; ok {
+				st.remove(el)
+			}
+		}
+	}
+}
+
+// Stops tracking a sound, returning it
+func (st *soundStore) remove(el *list.Element) *Sound {
+	s := el.Value.(*Sound)
+	st.lru.Remove(el)
+	delete(st.items, s)
+	st.used -= bufferSize(s.buffer)
+	return s
+}
+
+// Returns the current counters
+func (st *soundStore) Stats() soundStoreStats {
+	st.Lock()
+	defer st.Unlock()
+
+	return soundStoreStats{
+		Sounds:    len(st.items),
+		Bytes:     st.used,
+		Budget:    st.budget,
+		Hits:      st.hits,
+		Misses:    st.misses,
+		Evictions: st.evictions,
+	}
+}
+
+// Number of bytes used by a set of encoded frames
+func bufferSize(frames [][]byte) int64 {
+	size := int64(0)
+	for _, frame := range frames {
+		size += int64(len(frame))
+	}
+	return size
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Writes a 16 bit PCM WAV holding a sine wave, for sounds that need a file to load from
+func writeTestWAV(t testing.TB, path string, rate, channels int, seconds float64) {
+	samples := int(float64(rate) * seconds)
+	data := make([]byte, samples*channels*2)
+	for i := 0; i < samples; i++ {
+		v := int16(8000 * math.Sin(2*math.Pi*440*float64(i)/float64(rate)))
+		for c := 0; c < channels; c++ {
+			binary.LittleEndian.PutUint16(data[(i*channels+c)*2:], uint16(v))
+		}
+	}
+
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+len(data)))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], wavFormatPCM)
+	binary.LittleEndian.PutUint16(header[22:], uint16(channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(rate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(rate*channels*2))
+	binary.LittleEndian.PutUint16(header[32:], uint16(channels*2))
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(len(data)))
+
+	if err := ioutil.WriteFile(path, append(header, data...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Creates sounds backed by short WAV files in a temporary directory
+func testSounds(t testing.TB, count int) []*Sound {
+	dir := t.TempDir()
+
+	var sounds []*Sound
+	for i := 0; i < count; i++ {
+		s := createSound(string(rune('a'+i)), 1, 0)
+		s.File = filepath.Join(dir, s.Name+".wav")
+		writeTestWAV(t, s.File, SAMPLE_RATE, CHANNELS, 0.2)
+		sounds = append(sounds, s)
+	}
+	return sounds
+}
+
+func TestSoundStoreConcurrentFrames(t *testing.T) {
+	sounds := testSounds(t, 4)
+
+	// Small enough that every load evicts another sound
+	st := newSoundStore(1)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				frames, err := st.Frames(sounds[(g+i)%len(sounds)])
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(frames) == 0 {
+					t.Error("got no frames")
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	stats := st.Stats()
+	if stats.Sounds != 1 {
+		t.Errorf("store kept %d sounds, want 1", stats.Sounds)
+	}
+	if stats.Evictions == 0 {
+		t.Error("store never evicted anything")
+	}
+}
+
+func TestSoundStoreForget(t *testing.T) {
+	sounds := testSounds(t, 2)
+	st := newSoundStore(0)
+
+	loaded, err := st.Frames(sounds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued plays can still reach a forgotten sound, even once its file is gone
+	st.Forget(sounds)
+	os.Remove(sounds[0].File)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			frames, err := st.Frames(sounds[0])
+			if err != nil || len(frames) != len(loaded) {
+				t.Errorf("forgotten sound returned %d frames (%v), want %d", len(frames), err, len(loaded))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// One that was never loaded is read from disk but not tracked again
+	if _, err := st.Frames(sounds[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := st.Stats(); stats.Sounds != 0 || stats.Bytes != 0 {
+		t.Errorf("store is tracking %d sounds (%d bytes) after forgetting them all", stats.Sounds, stats.Bytes)
+	}
+}
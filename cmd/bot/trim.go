@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+)
+
+var (
+	// Level (in dBFS) below which audio counts as silence when trimming
+	SILENCE_THRESHOLD = -50.0
+)
+
+// Converts a duration in milliseconds into an index into 48kHz stereo PCM
+func msToSample(ms int) int {
+	return ms * SAMPLE_RATE / 1000 * CHANNELS
+}
+
+// Cuts PCM down to the section between start and end (in milliseconds), where an end of 0
+// means the end of the clip
+func trimRange(pcm []int16, start, end int) []int16 {
+	from := msToSample(start)
+	to := len(pcm)
+	if end > 0 && msToSample(end) < to {
+		to = msToSample(end)
+	}
+
+	if from >= to {
+		return pcm[:0]
+	}
+	return pcm[from:to]
+}
+
+// Cuts leading and trailing frames that never go above the threshold (in dBFS)
+func trimSilence(pcm []int16, threshold float64) []int16 {
+	limit := int(32767 * math.Pow(10, threshold/20))
+
+	loud := func(i int) bool {
+		for c := 0; c < CHANNELS; c++ {
+			v := int(pcm[i+c])
+			if v > limit || -v > limit {
+				return true
+			}
+		}
+		return false
+	}
+
+	from, to := 0, len(pcm)-len(pcm)%CHANNELS
+	for from < to && !loud(from) {
+		from += CHANNELS
+	}
+	for to > from && !loud(to-CHANNELS) {
+		to -= CHANNELS
+	}
+	return pcm[from:to]
+}
+
+// Applies linear fades (in milliseconds) to the start and end of PCM in place
+func applyFades(pcm []int16, fadeIn, fadeOut int) {
+	frames := len(pcm) / CHANNELS
+
+	if in := msToSample(fadeIn) / CHANNELS; in > 0 {
+		if in > frames {
+			in = frames
+		}
+		for i := 0; i < in; i++ {
+			scale := float64(i) / float64(in)
+			for c := 0; c < CHANNELS; c++ {
+				pcm[i*CHANNELS+c] = int16(float64(pcm[i*CHANNELS+c]) * scale)
+			}
+		}
+	}
+
+	if out := msToSample(fadeOut) / CHANNELS; out > 0 {
+		if out > frames {
+			out = frames
+		}
+		for i := 0; i < out; i++ {
+			scale := float64(i) / float64(out)
+			frame := frames - 1 - i
+			for c := 0; c < CHANNELS; c++ {
+				pcm[frame*CHANNELS+c] = int16(float64(pcm[frame*CHANNELS+c]) * scale)
+			}
+		}
+	}
+}
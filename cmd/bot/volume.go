@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/layeh/gopus"
+)
+
+const (
+	MIN_VOLUME = 0
+	MAX_VOLUME = 200
+)
+
+// Changes the volume of encoded frames as they're played, by decoding each one, scaling the
+// PCM and encoding it again. This costs CPU per play, but only for guilds that changed
+// their volume, and doesn't need any extra copies of the sound buffers in memory.
+type volumeFilter struct {
+	decoder *gopus.Decoder
+	encoder *gopus.Encoder
+	scale   float64
+}
+
+// Creates a filter that plays frames at the given volume percentage
+func newVolumeFilter(volume int, profile *EncoderProfile) (*volumeFilter, error) {
+	decoder, err := gopus.NewDecoder(SAMPLE_RATE, profile.Channels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decoder: %v", err)
+	}
+
+	encoder, err := profile.newEncoder()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encoder: %v", err)
+	}
+
+	return &volumeFilter{
+		decoder: decoder,
+		encoder: encoder,
+		scale:   float64(volume) / 100,
+	}, nil
+}
+
+// Returns the frame re-encoded at the filter's volume
+func (f *volumeFilter) Process(frame []byte) ([]byte, error) {
+	pcm, err := f.decoder.Decode(frame, FRAME_SIZE, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, sample := range pcm {
+		pcm[i] = clampInt16(float64(sample) * f.scale)
+	}
+
+	return f.encoder.Encode(pcm, FRAME_SIZE, FRAME_SIZE*CHANNELS*2)
+}
+
+// Shows the guild's volume, or changes it if the user is allowed to control playback
+func handleVolumeCommand(s *discordgo.Session, channel *discordgo.Channel, guild *discordgo.Guild, user *discordgo.User, args []string) {
+	if len(args) == 0 || args[0] == "" {
+		volume := getGuildSettings(guild.ID).Volume
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("Volume is %d%%", volume))
+		return
+	}
+
+	if !canControlPlayback(guild, user.ID) {
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("Only server managers and the %v role can change the volume", CONTROL_ROLE))
+		return
+	}
+
+	volume, err := strconv.Atoi(args[0])
+	if err != nil || volume < MIN_VOLUME || volume > MAX_VOLUME {
+		s.ChannelMessageSend(channel.ID, fmt.Sprintf("Volume must be a number from %d to %d", MIN_VOLUME, MAX_VOLUME))
+		return
+	}
+
+	updateGuildSettings(guild.ID, func(gs *GuildSettings) {
+		gs.Volume = volume
+	})
+
+	log.WithFields(log.Fields{
+		"guild":  guild.ID,
+		"user":   user.ID,
+		"volume": volume,
+	}).Info("Changed guild volume")
+
+	s.ChannelMessageSend(channel.ID, fmt.Sprintf("Volume set to %d%%", volume))
+}
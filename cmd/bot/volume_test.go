@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// Loads one of the decoder fixtures as a sound, returning its encoded frames
+func fixtureFrames(b *testing.B, file string) ([][]byte, *EncoderProfile) {
+	s := createSound(file, 1, 0)
+	s.File = filepath.Join("testdata", file)
+	if err := s.Load(); err != nil {
+		b.Fatal(err)
+	}
+	return s.buffer, s.encoderProfile()
+}
+
+// Measures the cost of playing a frame at each volume. Guilds at 100% send frames untouched,
+// so that case is the baseline the re-encoding filter is compared against.
+func BenchmarkVolumeFilter(b *testing.B) {
+	frames, profile := fixtureFrames(b, "stereo-44100.wav")
+
+	for _, volume := range []int{100, 50, 150} {
+		b.Run(fmt.Sprintf("%d%%", volume), func(b *testing.B) {
+			var filter *volumeFilter
+			if volume != 100 {
+				var err error
+				if filter, err = newVolumeFilter(volume, profile); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			var sent []byte
+			for i := 0; i < b.N; i++ {
+				frame := frames[i%len(frames)]
+				if filter != nil {
+					scaled, err := filter.Process(frame)
+					if err != nil {
+						b.Fatal(err)
+					}
+					frame = scaled
+				}
+				sent = frame
+			}
+			_ = sent
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+
+	// Largest fmt chunk we'll read, WAVE_FORMAT_EXTENSIBLE needs 40 bytes
+	maxWAVFormatSize = 64
+)
+
+// Format information read from a WAV "fmt " chunk
+type wavFormat struct {
+	AudioFormat   uint16
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+}
+
+// Decodes a PCM or IEEE float WAV stream into 48kHz stereo int16 samples
+func decodeWAV(r io.Reader) ([]int16, error) {
+	br := bufio.NewReader(r)
+
+	var header [12]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, errUnsupportedFormat
+	}
+
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, errUnsupportedFormat
+	}
+
+	var format *wavFormat
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(br, chunk[:]); err != nil {
+			return nil, fmt.Errorf("wav has no data chunk: %v", err)
+		}
+
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		switch id {
+		case "fmt ":
+			if size > maxWAVFormatSize {
+				return nil, fmt.Errorf("wav fmt chunk is %d bytes, more than the %d we accept", size, maxWAVFormatSize)
+			}
+
+			body := make([]byte, size)
+			if _, err := io.ReadFull(br, body); err != nil {
+				return nil, fmt.Errorf("failed to read wav fmt chunk: %v", err)
+			}
+
+			f, err := parseWAVFormat(body)
+			if err != nil {
+				return nil, err
+			}
+			format = f
+		case "data":
+			if format == nil {
+				return nil, fmt.Errorf("wav data chunk comes before fmt chunk")
+			}
+
+			// Some encoders write a bogus size for streamed data, so just read what we can
+			data, err := ioutil.ReadAll(io.LimitReader(br, size))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read wav data chunk: %v", err)
+			}
+
+			return toStereo48k(format.samples(data), int(format.Channels), int(format.SampleRate)), nil
+		default:
+			if _, err := io.CopyN(ioutil.Discard, br, size); err != nil {
+				return nil, fmt.Errorf("failed to skip wav %q chunk: %v", id, err)
+			}
+		}
+
+		// Chunks are padded to an even number of bytes
+		if size%2 == 1 {
+			br.ReadByte()
+		}
+	}
+}
+
+// Parses the body of a "fmt " chunk
+func parseWAVFormat(body []byte) (*wavFormat, error) {
+	if len(body) < 16 {
+		return nil, fmt.Errorf("wav fmt chunk is too short")
+	}
+
+	f := &wavFormat{
+		AudioFormat:   binary.LittleEndian.Uint16(body[0:2]),
+		Channels:      binary.LittleEndian.Uint16(body[2:4]),
+		SampleRate:    binary.LittleEndian.Uint32(body[4:8]),
+		ByteRate:      binary.LittleEndian.Uint32(body[8:12]),
+		BlockAlign:    binary.LittleEndian.Uint16(body[12:14]),
+		BitsPerSample: binary.LittleEndian.Uint16(body[14:16]),
+	}
+
+	// WAVE_FORMAT_EXTENSIBLE keeps the real format in the first two bytes of the sub format GUID
+	if f.AudioFormat == wavFormatExtensible {
+		if len(body) < 26 {
+			return nil, fmt.Errorf("wav extensible fmt chunk is too short")
+		}
+		f.AudioFormat = binary.LittleEndian.Uint16(body[24:26])
+	}
+
+	if f.Channels < 1 || f.Channels > 2 || f.SampleRate == 0 {
+		return nil, errUnsupportedFormat
+	}
+
+	switch {
+	case f.AudioFormat == wavFormatPCM && (f.BitsPerSample == 8 || f.BitsPerSample == 16 || f.BitsPerSample == 24 || f.BitsPerSample == 32):
+	case f.AudioFormat == wavFormatFloat && (f.BitsPerSample == 32 || f.BitsPerSample == 64):
+	default:
+		return nil, errUnsupportedFormat
+	}
+
+	return f, nil
+}
+
+// Converts raw sample data into int16 samples, keeping the original rate and channel layout
+func (f *wavFormat) samples(data []byte) []int16 {
+	width := int(f.BitsPerSample / 8)
+	count := len(data) / width
+	out := make([]int16, count)
+
+	for i := 0; i < count; i++ {
+		b := data[i*width : (i+1)*width]
+
+		switch {
+		case f.AudioFormat == wavFormatFloat && width == 4:
+			out[i] = floatToInt16(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+		case f.AudioFormat == wavFormatFloat && width == 8:
+			out[i] = floatToInt16(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		case width == 1:
+			// 8 bit wavs are unsigned
+			out[i] = int16(int(b[0])-128) << 8
+		case width == 2:
+			out[i] = int16(binary.LittleEndian.Uint16(b))
+		case width == 3:
+			out[i] = int16(uint16(b[1]) | uint16(b[2])<<8)
+		case width == 4:
+			out[i] = int16(binary.LittleEndian.Uint32(b) >> 16)
+		}
+	}
+
+	return out
+}